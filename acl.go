@@ -5,6 +5,7 @@ import (
 	"github.com/belowLevel/route_rule/acl"
 	"net"
 	"os"
+	"path/filepath"
 )
 
 const (
@@ -19,10 +20,14 @@ const (
 // - default: first outbound in the list, or if the list is empty, equal to direct
 // If the user-defined outbounds contain any of the above names, they will
 // override the built-in outbounds.
+//
+// With FakeIP set, requests to fake IPs are matched and connected by the
+// domain the address was handed out for, and never to the fake IP itself.
 type aclEngine struct {
 	RuleSet acl.CompiledRuleSet[acl.Outbound]
 	Default acl.Outbound
 	Name    string
+	FakeIP  acl.FakeIPMapper
 }
 
 type OutboundEntry struct {
@@ -31,16 +36,32 @@ type OutboundEntry struct {
 }
 
 func NewACLEngineFromString(rules string, outbounds []OutboundEntry, geoLoader acl.GeoLoader) (acl.Outbound, error) {
+	return NewACLEngineFromStringWithOptions(rules, outbounds, acl.CompileOptions{GeoLoader: geoLoader})
+}
+
+// NewACLEngineFromStringWithOptions is like NewACLEngineFromString, with
+// control over the compile options. CacheSize defaults to aclCacheSize.
+func NewACLEngineFromStringWithOptions(rules string, outbounds []OutboundEntry, opts acl.CompileOptions) (acl.Outbound, error) {
 	trs, err := acl.ParseTextRules(rules)
 	if err != nil {
 		return nil, err
 	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = aclCacheSize
+	}
 	obMap := outboundsToMap(outbounds)
-	rs, err := acl.Compile[acl.Outbound](trs, obMap, aclCacheSize, geoLoader)
+	if opts.FakeIP != nil {
+		for _, ob := range obMap {
+			if g, ok := ob.(acl.FakeIPGuard); ok {
+				g.SetFakeIP(opts.FakeIP)
+			}
+		}
+	}
+	rs, err := acl.CompileWithOptions[acl.Outbound](trs, obMap, opts)
 	if err != nil {
 		return nil, err
 	}
-	return &aclEngine{rs, obMap["default"], "aclEngine"}, nil
+	return &aclEngine{rs, obMap["default"], "aclEngine", opts.FakeIP}, nil
 }
 
 func NewACLEngineFromFile(filename string, outbounds []OutboundEntry, geoLoader acl.GeoLoader) (acl.Outbound, error) {
@@ -51,6 +72,20 @@ func NewACLEngineFromFile(filename string, outbounds []OutboundEntry, geoLoader
 	return NewACLEngineFromString(string(bs), outbounds, geoLoader)
 }
 
+// NewACLEngineFromFileWithOptions is like NewACLEngineFromFile, with control
+// over the compile options. Unless DataDir or DataFS is set, data files of
+// the rules are resolved relative to the rule file.
+func NewACLEngineFromFileWithOptions(filename string, outbounds []OutboundEntry, opts acl.CompileOptions) (acl.Outbound, error) {
+	bs, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DataDir == "" && opts.DataFS == nil {
+		opts.DataDir = filepath.Dir(filename)
+	}
+	return NewACLEngineFromStringWithOptions(string(bs), outbounds, opts)
+}
+
 func outboundsToMap(outbounds []OutboundEntry) map[string]acl.Outbound {
 	obMap := make(map[string]acl.Outbound)
 	for _, ob := range outbounds {
@@ -59,11 +94,23 @@ func outboundsToMap(outbounds []OutboundEntry) map[string]acl.Outbound {
 	return obMap
 }
 
-func (a *aclEngine) handle(reqAddr *acl.AddrEx) acl.Outbound {
+func (a *aclEngine) handle(ctx context.Context, reqAddr *acl.AddrEx) acl.Outbound {
 	if reqAddr.HostInfo == nil {
 		reqAddr.HostInfo = &acl.HostInfo{}
 	}
-	ob := a.RuleSet.Match(reqAddr)
+	if a.FakeIP != nil {
+		if err := unmapFakeIP(a.FakeIP, reqAddr); err != nil {
+			reqAddr.Err = err
+			return nil
+		}
+	}
+	ob := a.RuleSet.MatchContext(ctx, reqAddr)
+	if a.FakeIP != nil && reqAddr.Err == nil {
+		if err := checkResolved(a.FakeIP, reqAddr); err != nil {
+			reqAddr.Err = err
+			return nil
+		}
+	}
 	if ob == nil {
 		// No match, use default outbound
 		return a.Default
@@ -73,7 +120,7 @@ func (a *aclEngine) handle(reqAddr *acl.AddrEx) acl.Outbound {
 
 func (a *aclEngine) TCP(ctx context.Context, reqAddr *acl.AddrEx) (net.Conn, error) {
 	reqAddr.Proto = acl.ProtocolTCP
-	ob := a.handle(reqAddr)
+	ob := a.handle(ctx, reqAddr)
 	if reqAddr.Err != nil {
 		return nil, reqAddr.Err
 	}
@@ -83,12 +130,22 @@ func (a *aclEngine) TCP(ctx context.Context, reqAddr *acl.AddrEx) (net.Conn, err
 
 func (a *aclEngine) UDP(reqAddr *acl.AddrEx) (acl.UDPConn, error) {
 	reqAddr.Proto = acl.ProtocolUDP
-	ob := a.handle(reqAddr)
+	ob := a.handle(context.Background(), reqAddr)
 	if reqAddr.Err != nil {
 		return nil, reqAddr.Err
 	}
-	return ob.UDP(reqAddr)
+	conn, err := ob.UDP(reqAddr)
+	if err != nil || a.FakeIP == nil {
+		return conn, err
+	}
+	return newFakeIPUDPConn(conn, a.FakeIP), nil
 }
 func (a *aclEngine) GetName() string {
 	return a.Name
 }
+
+// Close releases the rule set of the engine. Call it when the engine is
+// replaced, e.g. after reloading the rules.
+func (a *aclEngine) Close() error {
+	return a.RuleSet.Close()
+}
@@ -1,11 +1,16 @@
 package acl
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/belowLevel/route_rule/acl/v2geo"
+	"io"
+	"io/fs"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 )
@@ -31,15 +36,129 @@ func (p Protocol) String() string {
 	}
 }
 
+// HostInfo holds the addresses of a host. IPv4 and IPv6 are the first
+// address of each family; IPs, if set, are all of them, IPv4 first.
+// The rest is the state of AddrEx.Resolve.
 type HostInfo struct {
 	IPv4 net.IP
 	IPv6 net.IP
+	IPs  []ResolvedIP
+
+	// ResolvedAt is when the host was resolved, zero if it hasn't been.
+	ResolvedAt time.Time
+	// ResolveErr is the error of the resolution, if any.
+	ResolveErr error
+	// Source is where the addresses came from.
+	Source ResolveSource
+}
+
+// Resolved reports whether the host was resolved, successfully or not.
+func (h *HostInfo) Resolved() bool {
+	return !h.ResolvedAt.IsZero()
+}
+
+// forgetResolve undoes a failed resolution, so that it is tried again.
+func (h *HostInfo) forgetResolve() {
+	if h.ResolveErr != nil {
+		h.ResolvedAt, h.ResolveErr, h.Source = time.Time{}, nil, ResolveSourceNone
+	}
+}
+
+// SetIPs sets IPs, IPv4 first, and IPv4 and IPv6 to the first address of
+// each family.
+func (h *HostInfo) SetIPs(ips []ResolvedIP) {
+	h.IPs = make([]ResolvedIP, 0, len(ips))
+	h.IPv4, h.IPv6 = nil, nil
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			h.IPs = append(h.IPs, ip)
+			if h.IPv4 == nil {
+				h.IPv4 = ip.IP
+			}
+		}
+	}
+	for _, ip := range ips {
+		if ip.IP.To4() == nil && ip.IP != nil {
+			h.IPs = append(h.IPs, ip)
+			if h.IPv6 == nil {
+				h.IPv6 = ip.IP
+			}
+		}
+	}
+}
+
+// Addrs returns all addresses of the host, IPv4 first. Without IPs, these
+// are IPv4 and IPv6, if set.
+func (h *HostInfo) Addrs() []net.IP {
+	if len(h.IPs) > 0 {
+		addrs := make([]net.IP, len(h.IPs))
+		for i, ip := range h.IPs {
+			addrs[i] = ip.IP
+		}
+		return addrs
+	}
+	var addrs []net.IP
+	if h.IPv4 != nil {
+		addrs = append(addrs, h.IPv4)
+	}
+	if h.IPv6 != nil {
+		addrs = append(addrs, h.IPv6)
+	}
+	return addrs
+}
+
+// AddrMatchMode is how address rules (IP, CIDR, geoip: and record:) match
+// hosts with more than one address.
+type AddrMatchMode int
+
+const (
+	// AddrMatchAny matches if any of the addresses does.
+	AddrMatchAny AddrMatchMode = iota
+	// AddrMatchAll matches if all of the addresses do.
+	AddrMatchAll
+)
+
+// match applies f to ips by the mode. No addresses never match.
+func (m AddrMatchMode) match(ips []net.IP, f func(net.IP) bool) bool {
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if f(ip) {
+			if m == AddrMatchAny {
+				return true
+			}
+		} else if m == AddrMatchAll {
+			return false
+		}
+	}
+	return m == AddrMatchAll
 }
 
 type CompiledRuleSet[O Outbound] interface {
 	Match(reqAddr *AddrEx) O
+	// MatchContext is like Match, with ctx bounding the resolution of the
+	// host that rules such as geoip: may need.
+	MatchContext(ctx context.Context, reqAddr *AddrEx) O
+	// Close releases the rule set: it stops following geo data updates and
+	// flushes record: rules. Call it once the rule set is replaced.
+	Close() error
 }
 
+// ResolveTimeoutPolicy is what a rule set does when resolving the host
+// times out during matching.
+type ResolveTimeoutPolicy int
+
+const (
+	// ResolveTimeoutFail fails the request with the timeout as its Err,
+	// like other resolution errors.
+	ResolveTimeoutFail ResolveTimeoutPolicy = iota
+	// ResolveTimeoutSkip treats the rules that needed the addresses as not
+	// matching and carries on with the rest. The host is left unresolved,
+	// for the outbound to try again.
+	ResolveTimeoutSkip
+)
+
 type compiledRule[O Outbound] struct {
 	Outbound      O
 	HostMatcher   hostMatcher
@@ -50,25 +169,58 @@ type compiledRule[O Outbound] struct {
 	Txt           string
 }
 
-func (r *compiledRule[O]) Match(reqAddr *AddrEx) bool {
+func (r *compiledRule[O]) Match(ctx context.Context, reqAddr *AddrEx) bool {
 	if r.Protocol != ProtocolBoth && r.Protocol != reqAddr.Proto {
 		return false
 	}
 	if r.StartPort != 0 && (reqAddr.Port < r.StartPort || reqAddr.Port > r.EndPort) {
 		return false
 	}
+	if m, ok := r.HostMatcher.(contextHostMatcher); ok {
+		return m.MatchContext(ctx, reqAddr)
+	}
 	return r.HostMatcher.Match(reqAddr)
 }
 
 type matchResult[O Outbound] struct {
 	Outbound O
 	Txt      string
+	Hit      string
 	Err      error
 }
 
 type compiledRuleSetImpl[O Outbound] struct {
-	Rules []compiledRule[O]
-	Cache *lru.Cache[matchResultCacheKey, matchResult[O]] // key: HostInfo.String()
+	Rules          []compiledRule[O]
+	Cache          *lru.Cache[matchResultCacheKey, matchResult[O]] // key: HostInfo.String()
+	ResolveTimeout time.Duration
+	TimeoutPolicy  ResolveTimeoutPolicy
+	// DNS holds the matchers of DNS rules, if any.
+	DNS io.Closer
+
+	unregister func()
+}
+
+func (s *compiledRuleSetImpl[O]) Close() error {
+	if s.unregister != nil {
+		s.unregister()
+	}
+	var errs []error
+	for _, rule := range s.Rules {
+		errs = append(errs, closeMatcher(rule.HostMatcher))
+	}
+	if s.DNS != nil {
+		errs = append(errs, s.DNS.Close())
+	}
+	s.Cache.Purge()
+	return errors.Join(errs...)
+}
+
+// closeMatcher releases what a matcher holds on to, if anything.
+func closeMatcher(m hostMatcher) error {
+	if c, ok := m.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
 }
 
 type matchResultCacheKey struct {
@@ -78,6 +230,10 @@ type matchResultCacheKey struct {
 }
 
 func (s *compiledRuleSetImpl[O]) Match(reqAddr *AddrEx) O {
+	return s.MatchContext(context.Background(), reqAddr)
+}
+
+func (s *compiledRuleSetImpl[O]) MatchContext(ctx context.Context, reqAddr *AddrEx) O {
 	reqAddr.Host = strings.ToLower(reqAddr.Host) // Normalize host name to lower case
 	key := matchResultCacheKey{
 		Host:  reqAddr.Host,
@@ -87,22 +243,75 @@ func (s *compiledRuleSetImpl[O]) Match(reqAddr *AddrEx) O {
 	if result, ok := s.Cache.Get(key); ok {
 		reqAddr.Err = result.Err
 		reqAddr.Txt = result.Txt
+		reqAddr.Hit = result.Hit
 		return result.Outbound
 	}
+	if s.ResolveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ResolveTimeout)
+		defer cancel()
+	}
+	var zero O
+	// Results after a timeout aren't cached, the next request may do better.
+	timedOut := false
 	for _, rule := range s.Rules {
-		if rule.Match(reqAddr) {
-			result := matchResult[O]{rule.Outbound, rule.Txt, reqAddr.Err}
-			s.Cache.Add(key, result)
+		reqAddr.Hit = ""
+		matched := rule.Match(ctx, reqAddr)
+		if reqAddr.Err != nil && isResolveCanceled(ctx, reqAddr) {
+			// The caller gave up, which says nothing about the host.
+			reqAddr.HostInfo.forgetResolve()
+			return zero
+		}
+		if !timedOut && reqAddr.Err != nil && isResolveTimeout(reqAddr) {
+			if s.TimeoutPolicy != ResolveTimeoutSkip {
+				return zero
+			}
+			timedOut = true
+			reqAddr.Err = nil
+		}
+		if matched {
+			result := matchResult[O]{rule.Outbound, rule.Txt, reqAddr.Hit, reqAddr.Err}
+			if timedOut {
+				reqAddr.HostInfo.forgetResolve()
+			} else {
+				s.Cache.Add(key, result)
+			}
 			reqAddr.Txt = result.Txt
 			return result.Outbound
 		}
 	}
+	reqAddr.Hit = ""
+	if timedOut {
+		reqAddr.HostInfo.forgetResolve()
+		return zero
+	}
 	// No match should also be cached
-	var zero O
-	s.Cache.Add(key, matchResult[O]{zero, "", nil})
+	s.Cache.Add(key, matchResult[O]{zero, "", "", nil})
 	return zero
 }
 
+// isResolveTimeout reports whether resolving the host of reqAddr timed out.
+func isResolveTimeout(reqAddr *AddrEx) bool {
+	if reqAddr.HostInfo == nil || reqAddr.HostInfo.ResolveErr == nil {
+		return false
+	}
+	err := reqAddr.HostInfo.ResolveErr
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isResolveCanceled reports whether resolving the host of reqAddr failed
+// because ctx was canceled.
+func isResolveCanceled(ctx context.Context, reqAddr *AddrEx) bool {
+	if reqAddr.HostInfo == nil || reqAddr.HostInfo.ResolveErr == nil {
+		return false
+	}
+	return errors.Is(reqAddr.HostInfo.ResolveErr, context.Canceled) || errors.Is(ctx.Err(), context.Canceled)
+}
+
 type CompilationError struct {
 	LineNum int
 	Message string
@@ -112,26 +321,110 @@ func (e *CompilationError) Error() string {
 	return fmt.Sprintf("error at line %d: %s", e.LineNum, e.Message)
 }
 
+// GeoLoader loads the GeoIP/GeoSite databases. ctx cancels the downloads
+// a load may need.
 type GeoLoader interface {
-	LoadGeoMMDB() (*IPReader, error)
-	LoadGeoSiteSSKV() (map[string]*v2geo.Set, error)
+	LoadGeoMMDB(ctx context.Context) (*IPReader, error)
+	// LoadGeoSiteSet returns the Set of a single GeoSite category,
+	// or nil if there is no such category.
+	LoadGeoSiteSet(ctx context.Context, name string) (*v2geo.Set, error)
+}
+
+// GeoUpdateNotifier is implemented by GeoLoaders that refresh their data while
+// compiled rules are in use, see GeoLoaderT.Start. GeoIP lookups pick up the
+// new database through the shared IPReader on their own.
+type GeoUpdateNotifier interface {
+	// OnGeoSiteUpdate registers fn to receive the new Set of a GeoSite
+	// category whenever it is rebuilt. The returned func unregisters it.
+	OnGeoSiteUpdate(name string, fn func(*v2geo.Set)) func()
+	// OnUpdate registers fn to be called after any update. The returned
+	// func unregisters it.
+	OnUpdate(fn func()) func()
+}
+
+// CompileOptions holds everything Compile needs besides the rules themselves.
+type CompileOptions struct {
+	CacheSize int
+	// We want on-demand loading of GeoIP/GeoSite databases, so instead of passing the
+	// databases directly, we use a GeoLoader interface to load them only when needed
+	// by at least one rule.
+	GeoLoader GeoLoader
+	// DataDir is where relative paths of domf: and record: rules are resolved.
+	// A leading "~" is expanded to the home directory. Defaults to the
+	// directory of the executable.
+	DataDir string
+	// DataFS, if set, is where relative paths of domf: rules are read from,
+	// instead of DataDir. record: rules need to write, so they never use it.
+	DataFS fs.FS
+	// Record is used by record: rules. Defaults to DefaultRecordOptions().
+	Record *RecordOptions
+	// Context cancels the loading of rule data, e.g. geo data downloads.
+	// Defaults to context.Background().
+	Context context.Context
+	// Resolver resolves hosts for geoip: and record: rules.
+	// Defaults to the system resolver.
+	Resolver Resolver
+	// Resolvers are the resolvers DNS rules can pick by name, see
+	// CompileDNSRules. Names MUST be in all lower case. When there are DNS
+	// rules, they replace Resolver, which becomes their fallback.
+	Resolvers map[string]Resolver
+	// AddrMatch is how address rules match hosts with more than one
+	// address. Defaults to AddrMatchAny.
+	AddrMatch AddrMatchMode
+	// ResolveTimeout, if set, bounds the resolution of the host during
+	// matching, on top of the deadline of the context given to MatchContext.
+	ResolveTimeout time.Duration
+	// ResolveTimeoutPolicy is what a resolve timeout means for the request.
+	// Defaults to ResolveTimeoutFail.
+	ResolveTimeoutPolicy ResolveTimeoutPolicy
+	// FakeIP, if set, is used by the ACL engine to match and connect
+	// requests to fake IPs by their domain. The engine also hands it to the
+	// outbounds that are FakeIPGuards.
+	FakeIP FakeIPMapper
+}
+
+func (o *CompileOptions) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
 }
 
 // Compile compiles TextRules into a CompiledRuleSet.
 // Names in the outbounds map MUST be in all lower case.
-// We want on-demand loading of GeoIP/GeoSite databases, so instead of passing the
-// databases directly, we use a GeoLoader interface to load them only when needed
-// by at least one rule.
+// See CompileOptions for the other parameters.
 func Compile[O Outbound](rules []TextRule, outbounds map[string]O,
 	cacheSize int, geoLoader GeoLoader,
 ) (CompiledRuleSet[O], error) {
+	return CompileWithOptions(rules, outbounds, CompileOptions{
+		CacheSize: cacheSize,
+		GeoLoader: geoLoader,
+	})
+}
+
+// CompileWithOptions is like Compile, with more control over how rules
+// find their data.
+func CompileWithOptions[O Outbound](rules []TextRule, outbounds map[string]O,
+	opts CompileOptions,
+) (CompiledRuleSet[O], error) {
+	trafficRules, hasDNS := splitDNSRules(rules)
+	var dns io.Closer
+	if hasDNS {
+		resolver, err := CompileDNSRules(rules, opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.Resolver = resolver
+		dns = resolver.(io.Closer)
+	}
+	rules = trafficRules
 	compiledRules := make([]compiledRule[O], len(rules))
 	for i, rule := range rules {
 		outbound, ok := outbounds[(rule.Outbound)]
 		if !ok {
 			return nil, &CompilationError{rule.LineNum, fmt.Sprintf("outbound %s not found", rule.Outbound)}
 		}
-		hm, errStr := compileHostMatcher(rule.Address, geoLoader)
+		hm, errStr := compileHostMatcher(rule.Address, &opts)
 		if errStr != "" {
 			return nil, &CompilationError{rule.LineNum, errStr}
 		}
@@ -148,11 +441,22 @@ func Compile[O Outbound](rules []TextRule, outbounds map[string]O,
 		}
 		compiledRules[i] = compiledRule[O]{outbound, hm, proto, startPort, endPort, hijackAddress, rule.Txt}
 	}
-	cache, err := lru.New[matchResultCacheKey, matchResult[O]](cacheSize)
+	cache, err := lru.New[matchResultCacheKey, matchResult[O]](opts.CacheSize)
 	if err != nil {
 		return nil, err
 	}
-	return &compiledRuleSetImpl[O]{compiledRules, cache}, nil
+	rs := &compiledRuleSetImpl[O]{
+		Rules:          compiledRules,
+		Cache:          cache,
+		ResolveTimeout: opts.ResolveTimeout,
+		TimeoutPolicy:  opts.ResolveTimeoutPolicy,
+		DNS:            dns,
+	}
+	if n, ok := opts.GeoLoader.(GeoUpdateNotifier); ok {
+		// Cached results may come from the old data.
+		rs.unregister = n.OnUpdate(cache.Purge)
+	}
+	return rs, nil
 }
 
 // parseProtoPort parses the protocol and port from a protoPort string.
@@ -227,8 +531,10 @@ func parseProtoPort(protoPort string) (Protocol, uint16, uint16, bool) {
 	}
 }
 
-func compileHostMatcher(addr string, geoLoader GeoLoader) (hostMatcher, string) {
+func compileHostMatcher(addr string, opts *CompileOptions) (hostMatcher, string) {
+	geoLoader := opts.GeoLoader
 
+	rawAddr := addr              // File paths keep their case
 	addr = strings.ToLower(addr) // Normalize to lower case
 	if addr == "*" || addr == "all" {
 		// Match all hosts
@@ -241,7 +547,7 @@ func compileHostMatcher(addr string, geoLoader GeoLoader) (hostMatcher, string)
 			return nil, "empty GeoIP country code"
 		}
 
-		ipReader, err := geoLoader.LoadGeoMMDB()
+		ipReader, err := geoLoader.LoadGeoMMDB(opts.context())
 		if err != nil {
 			return nil, err.Error()
 		}
@@ -249,6 +555,8 @@ func compileHostMatcher(addr string, geoLoader GeoLoader) (hostMatcher, string)
 		if err != nil {
 			return nil, err.Error()
 		}
+		m.resolver = opts.Resolver
+		m.mode = opts.AddrMatch
 		return m, ""
 	}
 	if strings.HasPrefix(addr, "geosite:") {
@@ -257,12 +565,11 @@ func compileHostMatcher(addr string, geoLoader GeoLoader) (hostMatcher, string)
 		if len(name) == 0 {
 			return nil, "empty GeoSite name"
 		}
-		gMap, err := geoLoader.LoadGeoSiteSSKV()
+		list, err := geoLoader.LoadGeoSiteSet(opts.context(), name)
 		if err != nil {
 			return nil, err.Error()
 		}
-		list, ok := gMap[name]
-		if !ok || list == nil {
+		if list == nil {
 			return nil, fmt.Sprintf("GeoSite name %s not found", name)
 		}
 		//m, err := newGeositeMatcher(list, attrs)
@@ -270,6 +577,9 @@ func compileHostMatcher(addr string, geoLoader GeoLoader) (hostMatcher, string)
 		if err != nil {
 			return nil, err.Error()
 		}
+		if n, ok := geoLoader.(GeoUpdateNotifier); ok {
+			m.unregister = n.OnGeoSiteUpdate(name, m.update)
+		}
 		return m, ""
 	}
 	if strings.HasPrefix(addr, "suffix:") {
@@ -284,18 +594,18 @@ func compileHostMatcher(addr string, geoLoader GeoLoader) (hostMatcher, string)
 		}, ""
 	}
 	if strings.HasPrefix(addr, "domf:") {
-		di, err := newFileDI(addr)
+		di, err := newFileDI("domf:"+rawAddr[len("domf:"):], opts)
 		if err != nil {
 			return nil, err.Error()
 		}
 		return di, ""
 	}
 	if strings.HasPrefix(addr, "record:") {
-		ipReader, err := geoLoader.LoadGeoMMDB()
+		ipReader, err := geoLoader.LoadGeoMMDB(opts.context())
 		if err != nil {
 			return nil, err.Error()
 		}
-		di, err := newRecord(addr, ipReader)
+		di, err := newRecord("record:"+rawAddr[len("record:"):], ipReader, opts)
 		if err != nil {
 			return nil, err.Error()
 		}
@@ -307,11 +617,11 @@ func compileHostMatcher(addr string, geoLoader GeoLoader) (hostMatcher, string)
 		if err != nil {
 			return nil, fmt.Sprintf("invalid CIDR address: %s", addr)
 		}
-		return &cidrMatcher{ipnet}, ""
+		return &cidrMatcher{IPNet: ipnet, Mode: opts.AddrMatch}, ""
 	}
 	if ip := net.ParseIP(addr); ip != nil {
 		// Single IP matcher
-		return &ipMatcher{ip}, ""
+		return &ipMatcher{IP: ip, Mode: opts.AddrMatch}, ""
 	}
 	if strings.Contains(addr, "*") {
 		// Wildcard domain matcher
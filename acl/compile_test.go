@@ -1,9 +1,16 @@
 package acl
 
 import (
+	"context"
 	"github.com/belowLevel/route_rule/acl/v2geo"
 	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
 )
 
 var _ GeoLoader = (*testGeoLoader)(nil)
@@ -18,11 +25,16 @@ func (l *testGeoLoader) LoadGeoSite() (map[string]*v2geo.GeoSite, error) {
 	return v2geo.LoadGeoSite("v2geo/geosite.dat")
 }
 
-func (l *testGeoLoader) LoadGeoSiteSSKV() (map[string]*v2geo.Set, error) {
-	return v2geo.LoadGeoSiteSSKV("v2geo/geosite.dat")
+func (l *testGeoLoader) LoadGeoSiteSet(ctx context.Context, name string) (*v2geo.Set, error) {
+	x, err := v2geo.OpenGeoSiteIndex("v2geo/geosite.dat")
+	if err != nil {
+		return nil, err
+	}
+	defer x.Close()
+	return x.LoadSet(name)
 }
 
-func (l *testGeoLoader) LoadGeoMMDB() (*IPReader, error) {
+func (l *testGeoLoader) LoadGeoMMDB(ctx context.Context) (*IPReader, error) {
 	return NewIPInstance("v2geo/country.mmdb")
 }
 
@@ -78,3 +90,66 @@ func Test_parseGeoSiteName(t *testing.T) {
 		})
 	}
 }
+
+type testOutbound struct {
+	name string
+}
+
+func (o *testOutbound) TCP(ctx context.Context, reqAddr *AddrEx) (net.Conn, error) {
+	return nil, nil
+}
+
+func (o *testOutbound) UDP(reqAddr *AddrEx) (UDPConn, error) {
+	return nil, nil
+}
+
+func (o *testOutbound) GetName() string {
+	return o.name
+}
+
+func TestCompiledRuleSetHit(t *testing.T) {
+	rs := &compiledRuleSetImpl[*testOutbound]{
+		Rules: []compiledRule[*testOutbound]{
+			{
+				Outbound:    &testOutbound{"test"},
+				HostMatcher: &DomainSet{Set: v2geo.NewSet([]string{"google.com"})},
+				Txt:         "test(geosite:google)",
+			},
+		},
+	}
+	rs.Cache, _ = lru.New[matchResultCacheKey, matchResult[*testOutbound]](16)
+	for i := 0; i < 2; i++ {
+		reqAddr := &AddrEx{Host: "www.google.com", HostInfo: &HostInfo{}}
+		assert.NotNil(t, rs.Match(reqAddr))
+		assert.Equal(t, "test(geosite:google)", reqAddr.Txt)
+		assert.Equal(t, "google.com", reqAddr.Hit)
+	}
+	reqAddr := &AddrEx{Host: "www.apple.com", HostInfo: &HostInfo{}}
+	assert.Nil(t, rs.Match(reqAddr))
+	assert.Empty(t, reqAddr.Hit)
+}
+
+func TestCompileFilePathCase(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Data")
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "Lists"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "Lists", "Domains.txt"), []byte("google.com\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "Lists", "Learned.txt"), []byte("apple.com\n"), 0o644))
+	l := &GeoLoaderT{MMDBSource: &GeoSource{Bytes: testMMDB(t, map[string]any{
+		"1.0.0.0/16": testCountry("US"),
+	})}}
+	defer l.CloseMMdb()
+
+	rs, err := CompileWithOptions([]TextRule{
+		{Outbound: "test", Address: "domf:Lists/Domains.txt", ProtoPort: "*", Txt: "test(domf)"},
+		{Outbound: "test", Address: "record:Lists/Learned.txt:AND:US", ProtoPort: "*", Txt: "test(record)"},
+		{Outbound: "test", Address: "DOMF:" + filepath.Join(dir, "Lists", "Domains.txt"), ProtoPort: "*", Txt: "test(abs)"},
+	}, map[string]*testOutbound{"test": {"test"}}, CompileOptions{
+		CacheSize: 16,
+		GeoLoader: l,
+		DataDir:   dir,
+		Record:    &RecordOptions{FlushInterval: time.Hour},
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, rs.Match(&AddrEx{Host: "www.google.com", HostInfo: &HostInfo{}}))
+	assert.NotNil(t, rs.Match(&AddrEx{Host: "www.apple.com", HostInfo: &HostInfo{}}))
+}
@@ -0,0 +1,65 @@
+package acl
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// expandHome expands a leading "~" to the home directory of the current user.
+func expandHome(name string) (string, error) {
+	if name != "~" && !strings.HasPrefix(name, "~/") && !strings.HasPrefix(name, "~"+string(filepath.Separator)) {
+		return name, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, name[1:]), nil
+}
+
+// dataPath resolves the path of a data file referenced by a rule.
+// Absolute paths and "~" are used as is, everything else is relative to
+// DataDir, or to the directory of the executable when it's not set.
+func (o *CompileOptions) dataPath(name string) (string, error) {
+	name, err := expandHome(name)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	dir := o.DataDir
+	if dir == "" {
+		ex, err := os.Executable()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Dir(ex)
+	}
+	dir, err = expandHome(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// readOnlyData resolves a read-only data file referenced by a rule.
+// When DataFS is set and the name is relative, the file is read from it,
+// otherwise fsys is nil and file is a path on disk.
+func (o *CompileOptions) readOnlyData(name string) (fsys fs.FS, file string, err error) {
+	if o.DataFS != nil && !filepath.IsAbs(name) && !strings.HasPrefix(name, "~") {
+		return o.DataFS, filepath.ToSlash(name), nil
+	}
+	file, err = o.dataPath(name)
+	return nil, file, err
+}
+
+// recordOptions returns the options for record: rules.
+func (o *CompileOptions) recordOptions() RecordOptions {
+	if o.Record == nil {
+		return DefaultRecordOptions()
+	}
+	return *o.Record
+}
@@ -0,0 +1,112 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// dnsRulePrefix marks rules that pick a resolver instead of an outbound:
+//
+//	dns:corp(suffix:corp.example)
+//	dns:doh(all)
+//
+// The resolver names refer to CompileOptions.Resolvers.
+const dnsRulePrefix = "dns:"
+
+var _ Resolver = (*dnsPolicy)(nil)
+
+// dnsPolicy is a Resolver that passes each host on to the resolver of the
+// first DNS rule that matches it, or to the fallback if none does.
+type dnsPolicy struct {
+	rules    []dnsRule
+	fallback Resolver
+}
+
+type dnsRule struct {
+	matcher  hostMatcher
+	resolver Resolver
+}
+
+// Close releases the matchers of the rules.
+func (p *dnsPolicy) Close() error {
+	var errs []error
+	for _, rule := range p.rules {
+		errs = append(errs, closeMatcher(rule.matcher))
+	}
+	return errors.Join(errs...)
+}
+
+func (p *dnsPolicy) Resolve(ctx context.Context, host string) ([]ResolvedIP, error) {
+	r := p.pick(host)
+	if r == nil {
+		r = &SystemResolver{}
+	}
+	return r.Resolve(ctx, host)
+}
+
+func (p *dnsPolicy) pick(host string) Resolver {
+	reqAddr := &AddrEx{Host: strings.ToLower(host), HostInfo: &HostInfo{}}
+	for _, rule := range p.rules {
+		if rule.matcher.Match(reqAddr) {
+			return rule.resolver
+		}
+	}
+	return p.fallback
+}
+
+// IsDNSRule reports whether r picks a resolver rather than an outbound.
+func IsDNSRule(r *TextRule) bool {
+	return strings.HasPrefix(r.Outbound, dnsRulePrefix)
+}
+
+// CompileDNSRules compiles the DNS rules among rules into a Resolver that
+// resolves each host through the resolver of the first rule matching it, or
+// through opts.Resolver if none does. Other rules are ignored.
+//
+// DNS rules match on the host name alone: geoip: and record: rules, which
+// need to resolve the host themselves, are not allowed.
+func CompileDNSRules(rules []TextRule, opts CompileOptions) (Resolver, error) {
+	policy := &dnsPolicy{fallback: opts.Resolver}
+	for _, rule := range rules {
+		if !IsDNSRule(&rule) {
+			continue
+		}
+		name := strings.ToLower(rule.Outbound[len(dnsRulePrefix):])
+		resolver, ok := opts.Resolvers[name]
+		if !ok {
+			return nil, &CompilationError{rule.LineNum, fmt.Sprintf("resolver %s not found", name)}
+		}
+		addr := strings.ToLower(rule.Address)
+		if strings.HasPrefix(addr, "geoip:") || strings.HasPrefix(addr, "record:") {
+			return nil, &CompilationError{rule.LineNum, fmt.Sprintf("%s can't be used in DNS rules", rule.Address)}
+		}
+		if rule.ProtoPort != "" && rule.ProtoPort != "*" || rule.HijackAddress != "" {
+			return nil, &CompilationError{rule.LineNum, "DNS rules take no protocol/port or hijack address"}
+		}
+		hm, errStr := compileHostMatcher(rule.Address, &opts)
+		if errStr != "" {
+			return nil, &CompilationError{rule.LineNum, errStr}
+		}
+		switch hm.(type) {
+		case *ipMatcher, *cidrMatcher:
+			// Only host names are ever resolved.
+			return nil, &CompilationError{rule.LineNum, fmt.Sprintf("IP address %s can't be used in DNS rules", rule.Address)}
+		}
+		policy.rules = append(policy.rules, dnsRule{hm, resolver})
+	}
+	return policy, nil
+}
+
+// splitDNSRules returns the rules that pick an outbound, and whether there
+// are DNS rules besides them.
+func splitDNSRules(rules []TextRule) ([]TextRule, bool) {
+	traffic := make([]TextRule, 0, len(rules))
+	for _, rule := range rules {
+		if !IsDNSRule(&rule) {
+			traffic = append(traffic, rule)
+		}
+	}
+	return traffic, len(traffic) < len(rules)
+}
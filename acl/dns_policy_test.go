@@ -0,0 +1,111 @@
+package acl
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDNSRules(t *testing.T) {
+	rules, err := ParseTextRules(`
+dns:corp(suffix:corp.example)
+dns:doh (all)
+direct(geoip:us)
+`)
+	assert.NoError(t, err)
+	if assert.Len(t, rules, 3) {
+		assert.Equal(t, "dns:corp", rules[0].Outbound)
+		assert.Equal(t, "suffix:corp.example", rules[0].Address)
+		assert.Equal(t, "dns:corp(suffix:corp.example)", rules[0].Txt)
+		assert.True(t, IsDNSRule(&rules[0]))
+		assert.Equal(t, "dns:doh", rules[1].Outbound)
+		assert.False(t, IsDNSRule(&rules[2]))
+		assert.Equal(t, "direct(geoip:us)", rules[2].Txt)
+	}
+}
+
+func TestCompileDNSRules(t *testing.T) {
+	corp := NewHostsResolver(map[string][]net.IP{
+		"git.corp.example": {net.ParseIP("1.0.0.1")},
+	}, nil)
+	doh := NewHostsResolver(map[string][]net.IP{
+		"git.corp.example": {net.ParseIP("2.0.0.1")},
+		"www.example.com":  {net.ParseIP("1.0.0.2")},
+	}, nil)
+	opts := CompileOptions{
+		Resolvers: map[string]Resolver{"corp": corp, "doh": doh},
+	}
+	rules, err := ParseTextRules(`
+dns:corp(suffix:corp.example)
+dns:doh(example.com)
+`)
+	assert.NoError(t, err)
+	r, err := CompileDNSRules(rules, opts)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	ips, err := LookupIP(ctx, r, "git.corp.example")
+	assert.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("1.0.0.1")}, ips)
+	// Hosts that no rule matches go to opts.Resolver.
+	opts.Resolver = doh
+	r, err = CompileDNSRules(rules, opts)
+	assert.NoError(t, err)
+	ips, err = LookupIP(ctx, r, "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("1.0.0.2")}, ips)
+
+	for _, text := range []string{
+		"dns:nope(all)",
+		"dns:corp(geoip:us)",
+		"dns:corp(record:r.txt:and:us)",
+		"dns:corp(1.1.1.1)",
+		"dns:corp(10.0.0.0/8)",
+		"dns:corp(2001:db8::/32)",
+		"dns:corp(all, udp/53)",
+		"dns:corp(all, *, 1.1.1.1)",
+	} {
+		rules, err := ParseTextRules(text)
+		assert.NoError(t, err, text)
+		_, err = CompileDNSRules(rules, opts)
+		var compErr *CompilationError
+		assert.ErrorAs(t, err, &compErr, text)
+	}
+}
+
+func TestCompileWithDNSRules(t *testing.T) {
+	l := &GeoLoaderT{
+		MMDBSource: &GeoSource{Bytes: testMMDB(t, map[string]any{
+			"1.0.0.0/16": testCountry("US"),
+			"2.0.0.0/16": testCountry("FR"),
+		})},
+	}
+	defer l.CloseMMdb()
+	// The same host resolves to the US internally, and to France outside.
+	corp := NewHostsResolver(map[string][]net.IP{
+		"git.corp.example": {net.ParseIP("1.0.0.1")},
+	}, nil)
+	doh := NewHostsResolver(map[string][]net.IP{
+		"git.corp.example": {net.ParseIP("2.0.0.1")},
+		"www.example.com":  {net.ParseIP("1.0.0.2")},
+	}, nil)
+	rules, err := ParseTextRules(`
+dns:corp(suffix:corp.example)
+dns:doh(all)
+test(geoip:us)
+`)
+	assert.NoError(t, err)
+	rs, err := CompileWithOptions(rules, map[string]*testOutbound{"test": {"test"}}, CompileOptions{
+		CacheSize: 16,
+		GeoLoader: l,
+		Resolvers: map[string]Resolver{"corp": corp, "doh": doh},
+	})
+	assert.NoError(t, err)
+
+	reqAddr := &AddrEx{Host: "git.corp.example", HostInfo: &HostInfo{}}
+	assert.NotNil(t, rs.Match(reqAddr))
+	assert.Equal(t, "1.0.0.1", reqAddr.HostInfo.IPv4.String())
+	assert.NotNil(t, rs.Match(&AddrEx{Host: "www.example.com", HostInfo: &HostInfo{}}))
+}
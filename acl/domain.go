@@ -1,23 +1,58 @@
 package acl
 
-import "github.com/belowLevel/route_rule/acl/v2geo"
+import (
+	"sync/atomic"
+
+	"github.com/belowLevel/route_rule/acl/v2geo"
+)
 
 type DomainSet struct {
 	Set *v2geo.Set
+
+	// updated replaces Set once the data behind it is refreshed.
+	updated atomic.Pointer[v2geo.Set]
+	// unregister stops the updates, if the Set gets any.
+	unregister func()
+}
+
+func (d *DomainSet) set() *v2geo.Set {
+	if set := d.updated.Load(); set != nil {
+		return set
+	}
+	return d.Set
+}
+
+// update swaps in a new Set, matches in progress keep using the old one.
+func (d *DomainSet) update(set *v2geo.Set) {
+	d.updated.Store(set)
+}
+
+// Close stops following updates of the Set.
+func (d *DomainSet) Close() error {
+	if d.unregister != nil {
+		d.unregister()
+	}
+	return nil
 }
 
 func (d *DomainSet) Match(reqAddr *AddrEx) bool {
-	if d.Set == nil {
+	set := d.set()
+	if set == nil {
 		return false
 	}
-	return d.Set.Has(reqAddr.Host)
+	hit, ok := set.Match(reqAddr.Host)
+	if ok {
+		reqAddr.Hit = hit
+	}
+	return ok
 }
 
 func (d *DomainSet) Size() int {
-	if d.Set == nil {
+	set := d.set()
+	if set == nil {
 		return 0
 	}
-	return d.Set.Size()
+	return set.Size()
 }
 
 func newSSKVMatcher(set *v2geo.Set, attrs []string) (*DomainSet, error) {
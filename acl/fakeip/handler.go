@@ -0,0 +1,118 @@
+package fakeip
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultTTL = time.Second
+
+var _ dns.Handler = (*Handler)(nil)
+
+// Handler is a DNS server that answers with fake IPs: A queries get an
+// address of the pool if it is IPv4, AAAA queries if it is IPv6, and the
+// other of the two gets an empty answer. PTR queries of fake IPs get the
+// domain back. Everything else is passed on to Next.
+type Handler struct {
+	Pool *Pool
+	// TTL of the answers. Defaults to 1 second, so that clients keep
+	// coming back for the address while they use it.
+	TTL time.Duration
+	// Exclude, if set, picks domains that get real answers from Next.
+	Exclude func(host string) bool
+	// Next answers the queries that aren't faked. Defaults to refusing them.
+	Next dns.Handler
+}
+
+func (h *Handler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 || req.Question[0].Qclass != dns.ClassINET {
+		h.next(w, req)
+		return
+	}
+	q := req.Question[0]
+	host := normalizeHost(q.Name)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		if h.Exclude != nil && h.Exclude(host) {
+			h.next(w, req)
+			return
+		}
+		ipv4 := h.Pool.Prefix().Addr().Is4()
+		if ipv4 == (q.Qtype == dns.TypeA) {
+			addr := h.Pool.Lookup(host)
+			resp.Answer = append(resp.Answer, h.addrRR(q.Name, addr))
+		}
+	case dns.TypePTR:
+		ip := net.ParseIP(reverseAddr(q.Name))
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok || !h.Pool.Contains(addr) {
+			h.next(w, req)
+			return
+		}
+		domain, ok := h.Pool.LookupHost(addr)
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+			break
+		}
+		resp.Answer = append(resp.Answer, &dns.PTR{
+			Hdr: h.header(q.Name, dns.TypePTR),
+			Ptr: dns.Fqdn(domain),
+		})
+	default:
+		h.next(w, req)
+		return
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func (h *Handler) next(w dns.ResponseWriter, req *dns.Msg) {
+	if h.Next != nil {
+		h.Next.ServeDNS(w, req)
+		return
+	}
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeRefused)
+	_ = w.WriteMsg(resp)
+}
+
+func (h *Handler) header(name string, rrtype uint16) dns.RR_Header {
+	ttl := h.TTL
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: uint32(ttl / time.Second)}
+}
+
+func (h *Handler) addrRR(name string, addr netip.Addr) dns.RR {
+	if addr.Is4() {
+		return &dns.A{Hdr: h.header(name, dns.TypeA), A: addr.AsSlice()}
+	}
+	return &dns.AAAA{Hdr: h.header(name, dns.TypeAAAA), AAAA: addr.AsSlice()}
+}
+
+// reverseAddr turns a PTR name such as 1.0.18.198.in-addr.arpa. back into
+// an address, or returns "" if it isn't one.
+func reverseAddr(name string) string {
+	labels := dns.SplitDomainName(name)
+	n := len(labels)
+	switch {
+	case n == 6 && labels[4] == "in-addr" && labels[5] == "arpa":
+		return labels[3] + "." + labels[2] + "." + labels[1] + "." + labels[0]
+	case n == 34 && labels[32] == "ip6" && labels[33] == "arpa":
+		buf := make([]byte, 0, 39)
+		for i := 31; i >= 0; i-- {
+			buf = append(buf, labels[i]...)
+			if i%4 == 0 && i > 0 {
+				buf = append(buf, ':')
+			}
+		}
+		return string(buf)
+	}
+	return ""
+}
@@ -0,0 +1,223 @@
+// Package fakeip hands out synthetic addresses for domains, so that
+// transparently proxied connections, which arrive with an address only, can
+// be matched and connected by their domain again.
+package fakeip
+
+import (
+	"bufio"
+	"errors"
+	"math/big"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/belowLevel/route_rule/acl"
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const defaultSize = 65536
+
+// DefaultPrefix is the range reserved for benchmarking (RFC 2544), which no
+// real host uses.
+var DefaultPrefix = netip.MustParsePrefix("198.18.0.0/15")
+
+var _ acl.FakeIPMapper = (*Pool)(nil)
+
+// Options controls a Pool. Zero values use the defaults.
+type Options struct {
+	// Prefix is where addresses are taken from. Defaults to DefaultPrefix.
+	Prefix netip.Prefix
+	// Size is the maximum number of domains. Beyond that, the address of the
+	// least recently used domain is reused. Defaults to 65536, or the size of
+	// Prefix if that is smaller.
+	Size int
+	// File, if set, is where the mappings are kept across restarts. It is
+	// read by NewPool and written by Save and Close.
+	File string
+}
+
+// Pool maps domains to addresses of a prefix and back.
+type Pool struct {
+	prefix netip.Prefix
+	size   int
+	file   string
+
+	mu     sync.Mutex
+	byHost *lru.Cache[string, netip.Addr]
+	byAddr map[netip.Addr]string
+	next   netip.Addr
+}
+
+func NewPool(opts Options) (*Pool, error) {
+	if !opts.Prefix.IsValid() {
+		opts.Prefix = DefaultPrefix
+	}
+	prefix := opts.Prefix.Masked()
+	// The first address of the prefix is never handed out.
+	capacity := new(big.Int).Lsh(big.NewInt(1), uint(prefix.Addr().BitLen()-prefix.Bits()))
+	capacity.Sub(capacity, big.NewInt(1))
+	if capacity.Sign() <= 0 {
+		return nil, errors.New("fake IP prefix too small: " + prefix.String())
+	}
+	size := opts.Size
+	if size <= 0 {
+		size = defaultSize
+	}
+	if capacity.IsInt64() && int64(size) > capacity.Int64() {
+		size = int(capacity.Int64())
+	}
+
+	p := &Pool{
+		prefix: prefix,
+		size:   size,
+		file:   opts.File,
+		byAddr: make(map[netip.Addr]string),
+		next:   prefix.Addr().Next(),
+	}
+	byHost, err := lru.NewWithEvict(size, func(host string, addr netip.Addr) {
+		delete(p.byAddr, addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.byHost = byHost
+	if p.file != "" {
+		if err := p.load(); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Prefix returns the range of the addresses.
+func (p *Pool) Prefix() netip.Prefix {
+	return p.prefix
+}
+
+// Lookup returns the address of host, handing out a new one if it has none.
+func (p *Pool) Lookup(host string) netip.Addr {
+	host = normalizeHost(host)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if addr, ok := p.byHost.Get(host); ok {
+		return addr
+	}
+	var addr netip.Addr
+	if p.byHost.Len() >= p.size {
+		// Reuse the address of the least recently used domain.
+		_, addr, _ = p.byHost.RemoveOldest()
+	} else {
+		addr = p.allocate()
+	}
+	p.byHost.Add(host, addr)
+	p.byAddr[addr] = host
+	return addr
+}
+
+// allocate returns the next address that isn't in use. There is one, as
+// the size is at most the number of addresses. Must hold p.mu.
+func (p *Pool) allocate() netip.Addr {
+	for {
+		addr := p.next
+		p.next = p.after(addr)
+		if _, ok := p.byAddr[addr]; !ok {
+			return addr
+		}
+	}
+}
+
+// after returns the address after addr, wrapping around at the end of the
+// prefix.
+func (p *Pool) after(addr netip.Addr) netip.Addr {
+	next := addr.Next()
+	if !next.IsValid() || !p.prefix.Contains(next) {
+		return p.prefix.Addr().Next()
+	}
+	return next
+}
+
+// Contains reports whether addr is in the range of the pool.
+func (p *Pool) Contains(addr netip.Addr) bool {
+	return p.prefix.Contains(addr.Unmap())
+}
+
+// LookupHost returns the domain addr was handed out for.
+func (p *Pool) LookupHost(addr netip.Addr) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host, ok := p.byAddr[addr.Unmap()]
+	if ok {
+		// In use, so keep it.
+		p.byHost.Get(host)
+	}
+	return host, ok
+}
+
+// Save writes the mappings to File, the least recently used first.
+func (p *Pool) Save() error {
+	if p.file == "" {
+		return nil
+	}
+	p.mu.Lock()
+	var sb strings.Builder
+	for _, host := range p.byHost.Keys() {
+		if addr, ok := p.byHost.Peek(host); ok {
+			sb.WriteString(addr.String() + " " + host + "\n")
+		}
+	}
+	p.mu.Unlock()
+	tmp := p.file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.file); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// Close saves the mappings.
+func (p *Pool) Close() error {
+	return p.Save()
+}
+
+// load reads "address domain" lines written by Save. Addresses outside the
+// prefix, e.g. after it was changed, are dropped.
+func (p *Pool) load() error {
+	f, err := os.Open(p.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || !p.prefix.Contains(addr) || addr == p.prefix.Addr() {
+			continue
+		}
+		host := normalizeHost(fields[1])
+		if old, ok := p.byAddr[addr]; ok {
+			p.byHost.Remove(old)
+		}
+		if old, ok := p.byHost.Peek(host); ok {
+			delete(p.byAddr, old)
+		}
+		p.byHost.Add(host, addr)
+		p.byAddr[addr] = host
+		// Carry on after the most recent one.
+		p.next = p.after(addr)
+	}
+	return scanner.Err()
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
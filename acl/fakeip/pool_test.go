@@ -0,0 +1,156 @@
+package fakeip
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	p, err := NewPool(Options{})
+	assert.NoError(t, err)
+	a := p.Lookup("a.example")
+	assert.Equal(t, "198.18.0.1", a.String())
+	assert.Equal(t, a, p.Lookup("A.example."))
+	b := p.Lookup("b.example")
+	assert.Equal(t, "198.18.0.2", b.String())
+
+	host, ok := p.LookupHost(b)
+	assert.True(t, ok)
+	assert.Equal(t, "b.example", host)
+	// As it comes from a net.IP.
+	host, ok = p.LookupHost(netip.AddrFrom16(a.As16()))
+	assert.True(t, ok)
+	assert.Equal(t, "a.example", host)
+
+	assert.True(t, p.Contains(netip.MustParseAddr("198.19.255.255")))
+	assert.False(t, p.Contains(netip.MustParseAddr("198.20.0.1")))
+	_, ok = p.LookupHost(netip.MustParseAddr("198.18.0.3"))
+	assert.False(t, ok)
+
+	_, err = NewPool(Options{Prefix: netip.MustParsePrefix("198.18.0.1/32")})
+	assert.Error(t, err)
+}
+
+func TestPoolReuse(t *testing.T) {
+	// 3 usable addresses.
+	p, err := NewPool(Options{Prefix: netip.MustParsePrefix("10.0.0.0/30"), Size: 100})
+	assert.NoError(t, err)
+	a := p.Lookup("a.example")
+	b := p.Lookup("b.example")
+	c := p.Lookup("c.example")
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, []string{a.String(), b.String(), c.String()})
+
+	// a is in use, so b is the least recently used.
+	_, _ = p.LookupHost(a)
+	d := p.Lookup("d.example")
+	assert.Equal(t, b, d)
+	_, ok := p.LookupHost(netip.MustParseAddr("10.0.0.2"))
+	assert.True(t, ok)
+	host, _ := p.LookupHost(d)
+	assert.Equal(t, "d.example", host)
+	assert.Equal(t, a, p.Lookup("a.example"))
+}
+
+func TestPoolIPv6(t *testing.T) {
+	p, err := NewPool(Options{Prefix: netip.MustParsePrefix("fd00:fa6e::/64")})
+	assert.NoError(t, err)
+	assert.Equal(t, "fd00:fa6e::1", p.Lookup("a.example").String())
+}
+
+func TestPoolPersist(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "fakeip.txt")
+	p, err := NewPool(Options{File: file})
+	assert.NoError(t, err)
+	a := p.Lookup("a.example")
+	b := p.Lookup("b.example")
+	assert.NoError(t, p.Close())
+
+	p, err = NewPool(Options{File: file})
+	assert.NoError(t, err)
+	host, ok := p.LookupHost(a)
+	assert.True(t, ok)
+	assert.Equal(t, "a.example", host)
+	assert.Equal(t, b, p.Lookup("b.example"))
+	assert.Equal(t, "198.18.0.3", p.Lookup("c.example").String())
+
+	// A different prefix drops the old mappings.
+	p, err = NewPool(Options{File: file, Prefix: netip.MustParsePrefix("10.0.0.0/8")})
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", p.Lookup("a.example").String())
+}
+
+// testResponseWriter captures the answer of a Handler.
+type testResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	p, err := NewPool(Options{})
+	assert.NoError(t, err)
+	next := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("192.0.2.1"),
+		})
+		_ = w.WriteMsg(resp)
+	})
+	h := &Handler{
+		Pool:    p,
+		Exclude: func(host string) bool { return host == "real.example" },
+		Next:    next,
+	}
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &testResponseWriter{}
+		h.ServeDNS(w, req)
+		return w.msg
+	}
+
+	resp := query("www.example.com.", dns.TypeA)
+	if assert.Len(t, resp.Answer, 1) {
+		a := resp.Answer[0].(*dns.A)
+		assert.Equal(t, "198.18.0.1", a.A.String())
+		assert.Equal(t, uint32(1), a.Hdr.Ttl)
+	}
+	resp = query("www.example.com.", dns.TypeAAAA)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+
+	resp = query("1.0.18.198.in-addr.arpa.", dns.TypePTR)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "www.example.com.", resp.Answer[0].(*dns.PTR).Ptr)
+	}
+	resp = query("9.0.18.198.in-addr.arpa.", dns.TypePTR)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	resp = query("real.example.", dns.TypeA)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", resp.Answer[0].(*dns.A).A.String())
+	}
+
+	h.Next = nil
+	resp = query("example.com.", dns.TypeMX)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+}
+
+func TestReverseAddr(t *testing.T) {
+	assert.Equal(t, "198.18.0.1", reverseAddr("1.0.18.198.in-addr.arpa."))
+	name, err := dns.ReverseAddr("fd00:fa6e::1")
+	assert.NoError(t, err)
+	assert.Equal(t, "fd00:fa6e::1", net.ParseIP(reverseAddr(name)).String())
+	assert.Equal(t, "", reverseAddr("example.com."))
+}
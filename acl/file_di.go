@@ -3,25 +3,29 @@ package acl
 import (
 	"bufio"
 	"github.com/belowLevel/route_rule/acl/v2geo"
+	"io"
+	"io/fs"
 	"os"
-	"path"
-	"path/filepath"
 	"strings"
 	"unicode"
 )
 
 type FileDI struct {
 	file string
+	fsys fs.FS // if set, file is a path in it
 	set  *v2geo.Set
 }
 
-func (d *FileDI) Init() error {
-	var strs []string
-	if _, err := os.Stat(d.file); err != nil {
-		return err
+func (d *FileDI) open() (io.ReadCloser, error) {
+	if d.fsys != nil {
+		return d.fsys.Open(d.file)
 	}
+	return os.Open(d.file)
+}
 
-	f, err := os.OpenFile(d.file, os.O_RDONLY, os.ModePerm)
+func (d *FileDI) Init() error {
+	var strs []string
+	f, err := d.open()
 	if err != nil {
 		return err
 	}
@@ -54,7 +58,11 @@ func (d *FileDI) Match(reqAddr *AddrEx) bool {
 	if d.set == nil {
 		return false
 	}
-	return d.set.Has(reqAddr.Host)
+	hit, ok := d.set.Match(reqAddr.Host)
+	if ok {
+		reqAddr.Hit = hit
+	}
+	return ok
 }
 
 func (d *FileDI) Size() int {
@@ -64,15 +72,15 @@ func (d *FileDI) Size() int {
 	return d.set.Size()
 }
 
-func newFileDI(file string) (*FileDI, error) {
+func newFileDI(file string, opts *CompileOptions) (*FileDI, error) {
 	suffix := file[5:]
-	ex, err := os.Executable()
+	fsys, name, err := opts.readOnlyData(suffix)
 	if err != nil {
 		return nil, err
 	}
-	workDir := filepath.Dir(ex)
 	fi := &FileDI{
-		file: path.Join(workDir, suffix),
+		file: name,
+		fsys: fsys,
 	}
 	err = fi.Init()
 	if err != nil {
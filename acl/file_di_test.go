@@ -2,11 +2,41 @@ package acl
 
 import (
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
+	"testing/fstest"
 )
 
 func TestNewFileDi(t *testing.T) {
-	d, err := newFileDI("domf:domain.txt")
+	d, err := newFileDI("domf:domain.txt", &CompileOptions{DataDir: "testdata"})
 	assert.NoError(t, err)
 	t.Logf("mem size %f MB", float32(d.Size())/1024/1024)
+	assert.True(t, d.Match(&AddrEx{Host: "mail.google.com"}))
+	assert.True(t, d.Match(&AddrEx{Host: "www.example.com"}))
+	assert.False(t, d.Match(&AddrEx{Host: "a.www.example.com"}))
+}
+
+func TestNewFileDiPaths(t *testing.T) {
+	abs, err := filepath.Abs("testdata/domain.txt")
+	assert.NoError(t, err)
+	d, err := newFileDI("domf:"+abs, &CompileOptions{DataDir: t.TempDir()})
+	assert.NoError(t, err)
+	assert.True(t, d.Match(&AddrEx{Host: "apple.com"}))
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	assert.NoError(t, os.WriteFile(filepath.Join(home, "home.txt"), []byte("home.example\n"), 0o644))
+	d, err = newFileDI("domf:~/home.txt", &CompileOptions{})
+	assert.NoError(t, err)
+	assert.True(t, d.Match(&AddrEx{Host: "home.example"}))
+
+	d, err = newFileDI("domf:lists/fs.txt", &CompileOptions{DataFS: fstest.MapFS{
+		"lists/fs.txt": {Data: []byte("fs.example\n")},
+	}})
+	assert.NoError(t, err)
+	assert.True(t, d.Match(&AddrEx{Host: "www.fs.example"}))
+
+	_, err = newFileDI("domf:missing.txt", &CompileOptions{DataDir: "testdata"})
+	assert.Error(t, err)
 }
@@ -0,0 +1,81 @@
+package acl
+
+import (
+	"context"
+	"sync"
+)
+
+// geoFlight runs at most one call per key at a time. Callers asking for a key
+// that is in flight wait for its result instead of starting their own call.
+//
+// Waits honor the context of each caller. The call itself runs in its own
+// goroutine, and its context is canceled once every caller waiting for it
+// gave up, so an abandoned download doesn't run to completion for nobody.
+// A later call of the same key starts only after the abandoned one returned,
+// as they would share files.
+type geoFlight[T any] struct {
+	mu        sync.Mutex
+	calls     map[string]*geoCall[T]
+	abandoned map[string]*geoCall[T]
+}
+
+type geoCall[T any] struct {
+	done    chan struct{}
+	val     T
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func (g *geoFlight[T]) do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*geoCall[T])
+		g.abandoned = make(map[string]*geoCall[T])
+	}
+	c, ok := g.calls[key]
+	if !ok {
+		prev := g.abandoned[key]
+		// Keep the values of ctx, but not its cancellation,
+		// which only ends the wait of this caller.
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &geoCall[T]{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			if prev != nil {
+				<-prev.done
+			}
+			c.val, c.err = fn(callCtx)
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			if g.abandoned[key] == c {
+				delete(g.abandoned, key)
+			}
+			g.mu.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+				g.abandoned[key] = c
+			}
+		}
+		g.mu.Unlock()
+		var zero T
+		return zero, ctx.Err()
+	}
+}
@@ -0,0 +1,74 @@
+package acl
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoFlightShared(t *testing.T) {
+	var g geoFlight[int]
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (int, error) {
+		calls.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := g.do(context.Background(), "k", fn)
+			assert.NoError(t, err)
+			assert.Equal(t, 42, v)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.EqualValues(t, 1, calls.Load())
+}
+
+func TestGeoFlightCancel(t *testing.T) {
+	var g geoFlight[int]
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		close(canceled)
+		return 0, ctx.Err()
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() { _, err := g.do(ctx1, "k", fn); errs <- err }()
+	go func() { _, err := g.do(ctx2, "k", fn); errs <- err }()
+	time.Sleep(20 * time.Millisecond)
+
+	// The call goes on while anyone still waits for it.
+	cancel1()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+	select {
+	case <-canceled:
+		t.Fatal("call canceled with a waiter left")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancel2()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+	<-canceled
+
+	// A new call starts afresh.
+	v, err := g.do(context.Background(), "k", func(ctx context.Context) (int, error) {
+		return 1, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, v)
+}
@@ -1,12 +1,27 @@
 package acl
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/belowLevel/route_rule/acl/v2geo"
 	"github.com/oschwald/maxminddb-golang/v2"
+	"hash/fnv"
 	"io"
+	"maps"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,15 +29,23 @@ import (
 const (
 	geositeFilename = "geosite.dat"
 	geositeURL      = "https://cdn.jsdelivr.net/gh/Loyalsoldier/v2ray-rules-dat@release/geosite.dat"
-	geoDlTmpPattern = ".hysteria-geoloader.dlpart.*"
+	geoPartSuffix   = ".dlpart" // interrupted downloads, resumed next time
+	geoMetaSuffix   = ".meta"   // ETag and Last-Modified of downloads
 
 	mmdbFilename = "country.mmdb"
 	mmdbURL      = "https://testingcf.jsdelivr.net/gh/MetaCubeX/meta-rules-dat@release/country.mmdb"
 
-	geoDefaultUpdateInterval = 7 * 24 * time.Hour // 7 days
+	geoDefaultUpdateInterval  = 7 * 24 * time.Hour // 7 days
+	geoDefaultDownloadTimeout = 10 * time.Minute
+	geoProgressInterval       = time.Second
+	// geoUpdateCheckInterval is how often Start checks whether the files are due.
+	geoUpdateCheckInterval = time.Hour
 )
 
-var _ GeoLoader = (*GeoLoaderT)(nil)
+var (
+	_ GeoLoader         = (*GeoLoaderT)(nil)
+	_ GeoUpdateNotifier = (*GeoLoaderT)(nil)
+)
 
 // GeoLoader provides the on-demand GeoIP/GeoSite database
 // loading functionality required by the ACL engine.
@@ -32,20 +55,92 @@ type GeoLoaderT struct {
 	GeoSiteFilename string        `json:"-" yaml:"-"`
 	UpdateInterval  time.Duration `json:"-" yaml:"-"`
 	GeositeURL      string        `json:"geosite-url" yaml:"geosite-url"`
+	// CacheDir, if set, keeps a precompiled copy of every GeoSite category in use,
+	// so that later starts can map them directly instead of rebuilding from geosite.dat.
+	CacheDir string `json:"cache-dir" yaml:"cache-dir"`
+
+	// GeoSiteSHA256 and MMDBSHA256 are the expected hex SHA-256 digests of the
+	// downloaded files. Alternatively, the *SHA256URL fields point to a
+	// .sha256sum file to fetch the expected digest from. Downloads that don't
+	// match are discarded.
+	GeoSiteSHA256    string `json:"geosite-sha256" yaml:"geosite-sha256"`
+	GeoSiteSHA256URL string `json:"geosite-sha256-url" yaml:"geosite-sha256-url"`
+	MMDBSHA256       string `json:"mmdb-sha256" yaml:"mmdb-sha256"`
+	MMDBSHA256URL    string `json:"mmdb-sha256-url" yaml:"mmdb-sha256-url"`
+
+	// Outbound, if set, is what downloads connect through, e.g. a socks5 or
+	// http outbound where the CDN is blocked. DialContext is used instead
+	// when Outbound is nil. Default: direct connections.
+	Outbound    Outbound                                                          `json:"-" yaml:"-"`
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error) `json:"-" yaml:"-"`
+	// DownloadTimeout limits each download as a whole. Default: 10 minutes.
+	DownloadTimeout time.Duration `json:"download-timeout" yaml:"download-timeout"`
+	// UserAgent is sent with download requests. Default: the one of net/http.
+	UserAgent string `json:"user-agent" yaml:"user-agent"`
+
+	// GeoSiteSource and MMDBSource, if set, provide the databases instead of
+	// GeoSiteFilename/MMDBFilename, and disable their downloads and updates.
+	GeoSiteSource *GeoSource `json:"-" yaml:"-"`
+	MMDBSource    *GeoSource `json:"-" yaml:"-"`
+	// MMDBSources are more MMDBs to consult before the one above, in order,
+	// e.g. a commercial database in front of the downloaded free one.
+	// The first database that knows an address wins.
+	MMDBSources []*GeoSource `json:"-" yaml:"-"`
+	// MMDBOverrideFile is a text file of "CIDR country" lines that takes
+	// precedence over all MMDBs, for local corrections. Only the country is
+	// overridden, the MMDBs still provide the continent, the registered
+	// country and the subdivisions. Update reloads it when it changes.
+	MMDBOverrideFile string `json:"mmdb-override" yaml:"mmdb-override"`
 
-	DownloadFunc    func(filename, url string) `json:"-" yaml:"-"`
-	DownloadErrFunc func(err error)            `json:"-" yaml:"-"`
+	// OnDownload, if set, is called when a download starts, as it makes
+	// progress, and once it is done.
+	OnDownload func(DownloadEvent) `json:"-" yaml:"-"`
 
 	geoipMap   map[string]*v2geo.GeoIP   `json:"-" yaml:"-"`
 	geositeMap map[string]*v2geo.GeoSite `json:"-" yaml:"-"`
 
-	geositeSSKVMap map[string]*v2geo.Set `json:"-" yaml:"-"`
-	MmdbURL        string                `json:"mmdb-url" yaml:"mmdb-url"`
+	geositeIndex *v2geo.GeoSiteIndex   `json:"-" yaml:"-"`
+	geositeSets  map[string]*v2geo.Set `json:"-" yaml:"-"`
+	geositeGen   uint64                `json:"-" yaml:"-"` // index swaps, see storeGeoSiteSet
+	MmdbURL      string                `json:"mmdb-url" yaml:"mmdb-url"`
+
+	MMDBFilename string    `json:"-" yaml:"-"`
+	ipreader     *IPReader `json:"-" yaml:"-"`
+	AutoDL       bool      `json:"auto-download" yaml:"auto-download"`
+
+	// Each database has its own lock, which is never held during a download.
+	// Concurrent loads of the same thing share one call through the flights.
+	mmdbLock     sync.Mutex                     `json:"-" yaml:"-"`
+	geositeLock  sync.Mutex                     `json:"-" yaml:"-"`
+	mmdbFlight   geoFlight[*IPReader]           `json:"-" yaml:"-"`
+	indexFlight  geoFlight[*v2geo.GeoSiteIndex] `json:"-" yaml:"-"`
+	setFlight    geoFlight[*v2geo.Set]          `json:"-" yaml:"-"`
+	updateFlight geoFlight[bool]                `json:"-" yaml:"-"`
+	// downloadFlight is keyed by file name, as loads and updates may both
+	// want to download the same file.
+	downloadFlight geoFlight[bool] `json:"-" yaml:"-"`
+
+	notifyLock      sync.Mutex                             `json:"-" yaml:"-"`
+	geositeWatchers map[string]map[uint64]func(*v2geo.Set) `json:"-" yaml:"-"`
+	updateFuncs     map[uint64]func()                      `json:"-" yaml:"-"`
+	notifyID        uint64                                 `json:"-" yaml:"-"`
+}
+
+// DownloadEvent reports the progress of a download, see GeoLoaderT.OnDownload.
+type DownloadEvent struct {
+	Filename string
+	URL      string
+	Bytes    int64 // received so far, including a resumed part
+	Total    int64 // size of the file, -1 if unknown
+	Done     bool
+	Err      error // only set when Done
+}
 
-	MMDBFilename string     `json:"-" yaml:"-"`
-	ipreader     *IPReader  `json:"-" yaml:"-"`
-	AutoDL       bool       `json:"auto-download" yaml:"auto-download"`
-	lock         sync.Mutex `json:"-" yaml:"-"`
+func (l *GeoLoaderT) updateInterval() time.Duration {
+	if l.UpdateInterval == 0 {
+		return geoDefaultUpdateInterval
+	}
+	return l.UpdateInterval
 }
 
 func (l *GeoLoaderT) shouldDownload(filename string) bool {
@@ -57,81 +152,502 @@ func (l *GeoLoaderT) shouldDownload(filename string) bool {
 		// empty files are loadable by v2geo, but we consider it broken
 		return true
 	}
-	dt := time.Now().Sub(info.ModTime())
-	if l.UpdateInterval == 0 {
-		return dt > geoDefaultUpdateInterval
-	} else {
-		return dt > l.UpdateInterval
+	last := info.ModTime()
+	// A 304 leaves the mtime alone, as it keys the cached Sets, and records
+	// the check in the sidecar instead.
+	if checked := time.Unix(readGeoMeta(filename).Checked, 0); checked.After(last) {
+		last = checked
 	}
+	return time.Since(last) > l.updateInterval()
 }
 
-func (l *GeoLoaderT) downloadAndCheck(filename, url string, checkFunc func(filename string) error) error {
-	l.DownloadFunc(filename, url)
+// geoChecksum is where the expected digest of a download comes from.
+type geoChecksum struct {
+	SHA256    string
+	SHA256URL string
+}
 
-	resp, err := http.Get(url)
+// expectedSHA256 returns the expected hex digest of a download, or "" if none
+// is configured.
+func (l *GeoLoaderT) expectedSHA256(ctx context.Context, client *http.Client, sum geoChecksum, fileURL string) (string, error) {
+	if sum.SHA256 != "" {
+		return strings.ToLower(strings.TrimSpace(sum.SHA256)), nil
+	}
+	if sum.SHA256URL == "" {
+		return "", nil
+	}
+	resp, err := l.httpGet(ctx, client, sum.SHA256URL)
 	if err != nil {
-		l.DownloadErrFunc(err)
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
+	bs, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	return parseSHA256Sum(string(bs), path.Base(fileURL))
+}
+
+// parseSHA256Sum extracts a digest from the output of sha256sum.
+// With several lines, the one for the given file name is used.
+func parseSHA256Sum(content, name string) (string, error) {
+	var digests []string
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		digest := strings.ToLower(fields[0])
+		if len(digest) != sha256.Size*2 {
+			continue
+		}
+		if _, err := hex.DecodeString(digest); err != nil {
+			continue
+		}
+		if len(fields) > 1 && strings.TrimPrefix(fields[1], "*") == name {
+			return digest, nil
+		}
+		digests = append(digests, digest)
+	}
+	if len(digests) != 1 {
+		return "", fmt.Errorf("no SHA-256 digest for %s found", name)
+	}
+	return digests[0], nil
+}
+
+// httpClient returns the client downloads are made with, which dials through
+// Outbound or DialContext if set.
+func (l *GeoLoaderT) httpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if l.Outbound != nil {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, portStr, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			port, err := strconv.ParseUint(portStr, 10, 16)
+			if err != nil {
+				return nil, err
+			}
+			return l.Outbound.TCP(ctx, &AddrEx{
+				Host:     host,
+				Port:     uint16(port),
+				HostInfo: &HostInfo{},
+			})
+		}
+	} else if l.DialContext != nil {
+		transport.Proxy = nil
+		transport.DialContext = l.DialContext
+	}
+	return &http.Client{Transport: transport}
+}
 
-	f, err := os.CreateTemp(".", geoDlTmpPattern)
+func (l *GeoLoaderT) newRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		l.DownloadErrFunc(err)
-		return err
+		return nil, err
 	}
-	defer os.Remove(f.Name())
+	if l.UserAgent != "" {
+		req.Header.Set("User-Agent", l.UserAgent)
+	}
+	return req, nil
+}
 
-	_, err = io.Copy(f, resp.Body)
+func (l *GeoLoaderT) httpGet(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := l.newRequest(ctx, url)
 	if err != nil {
-		f.Close()
-		l.DownloadErrFunc(err)
-		return err
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download %s failed: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// geoMeta is kept in a sidecar file next to a downloaded file, with the
+// validators of the file and of an interrupted download of its next version,
+// and when the server last said the file is up to date.
+type geoMeta struct {
+	ETag             string `json:"etag,omitempty"`
+	LastModified     string `json:"last_modified,omitempty"`
+	PartETag         string `json:"part_etag,omitempty"`
+	PartLastModified string `json:"part_last_modified,omitempty"`
+	Checked          int64  `json:"checked,omitempty"` // unix seconds
+}
+
+func readGeoMeta(filename string) geoMeta {
+	var m geoMeta
+	bs, err := os.ReadFile(filename + geoMetaSuffix)
+	if err == nil {
+		// A broken sidecar only costs a full download.
+		_ = json.Unmarshal(bs, &m)
 	}
-	f.Close()
+	return m
+}
 
-	err = checkFunc(f.Name())
+func writeGeoMeta(filename string, m geoMeta) error {
+	if m == (geoMeta{}) {
+		err := os.Remove(filename + geoMetaSuffix)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	bs, err := json.Marshal(m)
 	if err != nil {
-		l.DownloadErrFunc(fmt.Errorf("integrity check failed: %w", err))
 		return err
 	}
+	return os.WriteFile(filename+geoMetaSuffix, bs, 0o644)
+}
+
+// ifRange returns the validator for an If-Range header, preferring the ETag
+// unless it is weak, which If-Range doesn't allow.
+func ifRange(etag, lastModified string) string {
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return lastModified
+}
+
+func (l *GeoLoaderT) notifyDownload(ev DownloadEvent) {
+	if l.OnDownload != nil {
+		l.OnDownload(ev)
+	}
+}
+
+// progressWriter reports the bytes written through it to OnDownload, at most
+// once per geoProgressInterval.
+type progressWriter struct {
+	l    *GeoLoaderT
+	ev   DownloadEvent
+	last time.Time
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.ev.Bytes += int64(len(p))
+	if now := time.Now(); now.Sub(w.last) >= geoProgressInterval {
+		w.last = now
+		w.l.notifyDownload(w.ev)
+	}
+	return len(p), nil
+}
+
+// downloadAndCheck downloads url to filename, unless the server says the
+// current file is still up to date. The download goes to filename+".dlpart"
+// first, and is resumed from there if it was interrupted before. The file is
+// only replaced once it passes the checksum and checkFunc. Reports whether
+// the file was replaced. Callers that find the current file broken must
+// remove it first, or the server may say it is up to date.
+// Concurrent downloads of the same file are shared.
+func (l *GeoLoaderT) downloadAndCheck(ctx context.Context, filename, url string, sum geoChecksum, checkFunc func(filename string) error) (bool, error) {
+	return l.downloadFlight.do(ctx, filename, func(ctx context.Context) (bool, error) {
+		l.notifyDownload(DownloadEvent{Filename: filename, URL: url, Total: -1})
+		updated, err := l.download(ctx, filename, url, sum, checkFunc)
+		l.notifyDownload(DownloadEvent{Filename: filename, URL: url, Total: -1, Done: true, Err: err})
+		return updated, err
+	})
+}
+
+func (l *GeoLoaderT) download(ctx context.Context, filename, url string, sum geoChecksum, checkFunc func(filename string) error) (bool, error) {
+	timeout := l.DownloadTimeout
+	if timeout == 0 {
+		timeout = geoDefaultDownloadTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	client := l.httpClient()
+	defer client.CloseIdleConnections()
+
+	req, err := l.newRequest(ctx, url)
+	if err != nil {
+		return false, err
+	}
+	meta := readGeoMeta(filename)
+	// Only ask for changes when there is a current file.
+	if meta.ETag != "" || meta.LastModified != "" {
+		if _, err := os.Stat(filename); err == nil {
+			if meta.ETag != "" {
+				req.Header.Set("If-None-Match", meta.ETag)
+			}
+			if meta.LastModified != "" {
+				req.Header.Set("If-Modified-Since", meta.LastModified)
+			}
+		} else {
+			meta.ETag, meta.LastModified = "", ""
+		}
+	}
+	part := filename + geoPartSuffix
+	var offset int64
+	if v := ifRange(meta.PartETag, meta.PartLastModified); v != "" {
+		if info, err := os.Stat(part); err == nil && info.Size() > 0 {
+			offset = info.Size()
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			req.Header.Set("If-Range", v)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		meta.Checked = time.Now().Unix()
+		return false, writeGeoMeta(filename, meta)
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return false, fmt.Errorf("download %s failed: unexpected Content-Range %q", url, resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+	default:
+		return false, fmt.Errorf("download %s failed: %s", url, resp.Status)
+	}
+	expected, err := l.expectedSHA256(ctx, client, sum, url)
+	if err != nil {
+		return false, err
+	}
+	if etag, lm := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"); resp.StatusCode == http.StatusOK || etag != "" || lm != "" {
+		meta.PartETag, meta.PartLastModified = etag, lm
+	}
+	// Remember what the part belongs to, so it can be resumed.
+	if err := writeGeoMeta(filename, meta); err != nil {
+		return false, err
+	}
+
+	f, err := os.OpenFile(part, flags, 0o644)
+	if err != nil {
+		return false, err
+	}
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	pw := &progressWriter{l: l, ev: DownloadEvent{Filename: filename, URL: url, Bytes: offset, Total: total}}
+	_, err = io.Copy(io.MultiWriter(f, pw), resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Keep the part for the next attempt.
+		return false, err
+	}
+
+	discard := func(err error) error {
+		_ = os.Remove(part)
+		meta.PartETag, meta.PartLastModified = "", ""
+		_ = writeGeoMeta(filename, meta)
+		return fmt.Errorf("integrity check failed: %w", err)
+	}
+	if expected != "" {
+		actual, err := fileSHA256(part)
+		if err != nil {
+			return false, err
+		}
+		if actual != expected {
+			return false, discard(fmt.Errorf("SHA-256 mismatch: expected %s, got %s", expected, actual))
+		}
+	}
+	if err := checkFunc(part); err != nil {
+		return false, discard(err)
+	}
+
+	if err := os.Rename(part, filename); err != nil {
+		return false, fmt.Errorf("rename failed: %w", err)
+	}
+	return true, writeGeoMeta(filename, geoMeta{
+		ETag:         meta.PartETag,
+		LastModified: meta.PartLastModified,
+	})
+}
+
+func fileSHA256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	err = os.Rename(f.Name(), filename)
+// checkMMDB makes sure a file is a MaxMind DB with country data in it.
+func checkMMDB(filename string) error {
+	db, err := maxminddb.Open(filename)
 	if err != nil {
-		l.DownloadErrFunc(fmt.Errorf("rename failed: %w", err))
 		return err
 	}
+	defer db.Close()
+	return checkMMDBMetadata(db.Metadata)
+}
 
+func checkMMDBMetadata(md maxminddb.Metadata) error {
+	if md.BinaryFormatMajorVersion != 2 {
+		return fmt.Errorf("unsupported MMDB format version %d", md.BinaryFormatMajorVersion)
+	}
+	if md.NodeCount == 0 {
+		return errors.New("empty MMDB")
+	}
+	dbType := strings.ToLower(md.DatabaseType)
+	if !strings.Contains(dbType, "country") && !strings.Contains(dbType, "city") && !strings.Contains(dbType, "geoip") {
+		return fmt.Errorf("MMDB database type %q has no country data", md.DatabaseType)
+	}
 	return nil
 }
 
-func (l *GeoLoaderT) LoadGeoSiteSSKV() (map[string]*v2geo.Set, error) {
-	l.lock.Lock()
-	defer l.lock.Unlock()
-	if l.geositeSSKVMap != nil {
-		return l.geositeSSKVMap, nil
+// LoadGeoSiteSet returns the Set for a single GeoSite category, or nil if the
+// category doesn't exist. The data file is only indexed once, and each
+// category is built the first time it is asked for.
+func (l *GeoLoaderT) LoadGeoSiteSet(ctx context.Context, name string) (*v2geo.Set, error) {
+	l.geositeLock.Lock()
+	set, ok := l.geositeSets[name]
+	l.geositeLock.Unlock()
+	if ok {
+		return set, nil
+	}
+	return l.storeGeoSiteSet(ctx, name)
+}
+
+// storeGeoSiteSet builds the Set of a category and stores it. Loads and
+// updates of a category share one call, and a Set built while the index was
+// being swapped is built again, so that an old Set never replaces a new one.
+func (l *GeoLoaderT) storeGeoSiteSet(ctx context.Context, name string) (*v2geo.Set, error) {
+	return l.setFlight.do(ctx, name, func(ctx context.Context) (*v2geo.Set, error) {
+		for {
+			l.geositeLock.Lock()
+			gen := l.geositeGen
+			l.geositeLock.Unlock()
+			set, err := l.loadCachedGeoSiteSet(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			l.geositeLock.Lock()
+			if gen != l.geositeGen {
+				l.geositeLock.Unlock()
+				continue
+			}
+			if l.geositeSets == nil {
+				l.geositeSets = make(map[string]*v2geo.Set)
+			}
+			l.geositeSets[name] = set
+			l.geositeLock.Unlock()
+			return set, nil
+		}
+	})
+}
+
+// loadCachedGeoSiteSet serves a category from CacheDir when the cached copy was
+// built from the current data file, and otherwise builds it and refreshes the
+// cache.
+func (l *GeoLoaderT) loadCachedGeoSiteSet(ctx context.Context, name string) (*v2geo.Set, error) {
+	if l.CacheDir == "" || l.GeoSiteSource != nil {
+		return l.buildGeoSiteSet(ctx, name)
 	}
 	filename := l.GeoSiteFilename
 	if filename == "" {
 		filename = geositeFilename
 	}
-	downUrl := l.GeositeURL
-	if downUrl == "" {
-		downUrl = geositeURL
+	cacheFile := filepath.Join(l.CacheDir, url.PathEscape(name)+".sskv")
+	stamp, serr := geositeStamp(filename)
+	if serr == nil && (!l.AutoDL || !l.shouldDownload(filename)) {
+		if set, err := v2geo.LoadSetFile(cacheFile, stamp); err == nil {
+			return set, nil
+		}
+		// missing, stale or broken, rebuild it
+	}
+	set, err := l.buildGeoSiteSet(ctx, name)
+	if err != nil || set == nil {
+		return set, err
+	}
+	if serr != nil {
+		// Just downloaded.
+		stamp, serr = geositeStamp(filename)
+	}
+	if serr == nil && os.MkdirAll(l.CacheDir, 0o755) == nil {
+		// The cache is an optimization only, failing to write it is fine.
+		_ = v2geo.WriteSetFile(cacheFile, set, stamp)
+	}
+	return set, nil
+}
+
+// geositeStamp identifies a version of the data file by its size and
+// modification time, for the cached Sets built from it.
+func geositeStamp(filename string) (uint64, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	h := fnv.New64a()
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], uint64(info.Size()))
+	binary.LittleEndian.PutUint64(b[8:], uint64(info.ModTime().UnixNano()))
+	h.Write(b[:])
+	return h.Sum64(), nil
+}
+
+func (l *GeoLoaderT) buildGeoSiteSet(ctx context.Context, name string) (*v2geo.Set, error) {
+	if _, err := l.loadGeoSiteIndex(ctx); err != nil {
+		return nil, err
+	}
+	// Hold the lock while reading, so that an update doesn't close the index
+	// under our feet.
+	l.geositeLock.Lock()
+	defer l.geositeLock.Unlock()
+	return l.geositeIndex.LoadSet(name)
+}
+
+func (l *GeoLoaderT) loadGeoSiteIndex(ctx context.Context) (*v2geo.GeoSiteIndex, error) {
+	l.geositeLock.Lock()
+	x := l.geositeIndex
+	l.geositeLock.Unlock()
+	if x != nil {
+		return x, nil
+	}
+	return l.indexFlight.do(ctx, "", func(ctx context.Context) (*v2geo.GeoSiteIndex, error) {
+		filename := l.GeoSiteFilename
+		if filename == "" {
+			filename = geositeFilename
+		}
+		x, err := l.openGeoSiteIndex(ctx, filename)
+		if err != nil {
+			return nil, err
+		}
+		l.geositeLock.Lock()
+		defer l.geositeLock.Unlock()
+		l.geositeIndex = x
+		return x, nil
+	})
+}
+
+func (l *GeoLoaderT) openGeoSiteIndex(ctx context.Context, filename string) (*v2geo.GeoSiteIndex, error) {
+	if l.GeoSiteSource != nil {
+		return l.GeoSiteSource.openGeoSiteIndex()
 	}
 	if l.AutoDL {
 		if !l.shouldDownload(filename) {
-			m, err := v2geo.LoadGeoSiteSSKV(filename)
+			x, err := v2geo.OpenGeoSiteIndex(filename)
 			if err == nil {
-				l.geositeSSKVMap = m
-				return m, nil
+				return x, nil
 			}
-			// file is broken, download it again
+			// file is broken, download it again from scratch
+			_ = os.Remove(filename)
 		}
-		err := l.downloadAndCheck(filename, downUrl, func(filename string) error {
-			_, err := v2geo.LoadGeoSite(filename)
-			return err
-		})
+		_, err := l.downloadGeoSite(ctx, filename)
 		if err != nil {
 			// as long as the previous download exists, fallback to it
 			if _, serr := os.Stat(filename); os.IsNotExist(serr) {
@@ -139,40 +655,84 @@ func (l *GeoLoaderT) LoadGeoSiteSSKV() (map[string]*v2geo.Set, error) {
 			}
 		}
 	}
-	m, err := v2geo.LoadGeoSiteSSKV(filename)
-	if err != nil {
-		return nil, err
+	return v2geo.OpenGeoSiteIndex(filename)
+}
+
+func (l *GeoLoaderT) downloadGeoSite(ctx context.Context, filename string) (bool, error) {
+	downUrl := l.GeositeURL
+	if downUrl == "" {
+		downUrl = geositeURL
 	}
-	l.geositeSSKVMap = m
-	return m, nil
+	return l.downloadAndCheck(ctx, filename, downUrl, geoChecksum{l.GeoSiteSHA256, l.GeoSiteSHA256URL}, func(filename string) error {
+		x, err := v2geo.OpenGeoSiteIndex(filename)
+		if err != nil {
+			return err
+		}
+		return x.Close()
+	})
 }
 
-func (l *GeoLoaderT) LoadGeoMMDB() (*IPReader, error) {
-	l.lock.Lock()
-	defer l.lock.Unlock()
-	if l.ipreader != nil {
-		return l.ipreader, nil
+func (l *GeoLoaderT) LoadGeoMMDB(ctx context.Context) (*IPReader, error) {
+	l.mmdbLock.Lock()
+	r := l.ipreader
+	l.mmdbLock.Unlock()
+	if r != nil {
+		return r, nil
 	}
-	filename := l.MMDBFilename
-	if filename == "" {
-		filename = mmdbFilename
+	return l.mmdbFlight.do(ctx, "", func(ctx context.Context) (*IPReader, error) {
+		filename := l.MMDBFilename
+		if filename == "" {
+			filename = mmdbFilename
+		}
+		m, err := l.openMMDB(ctx, filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := l.addMMDBLayers(m); err != nil {
+			_ = m.Close()
+			return nil, err
+		}
+		l.mmdbLock.Lock()
+		defer l.mmdbLock.Unlock()
+		l.ipreader = m
+		return m, nil
+	})
+}
+
+// addMMDBLayers puts MMDBSources and MMDBOverrideFile in front of r.
+func (l *GeoLoaderT) addMMDBLayers(r *IPReader) error {
+	for _, src := range l.MMDBSources {
+		layer, err := src.openMMDB()
+		if err != nil {
+			// Closing r closes the layers added so far.
+			return err
+		}
+		r.layers = append(r.layers, layer)
 	}
-	downUrl := l.MmdbURL
-	if downUrl == "" {
-		downUrl = mmdbURL
+	if l.MMDBOverrideFile != "" {
+		o, err := loadIPOverrides(l.MMDBOverrideFile)
+		if err != nil {
+			return err
+		}
+		r.overrides.Store(o)
+	}
+	return nil
+}
+
+func (l *GeoLoaderT) openMMDB(ctx context.Context, filename string) (*IPReader, error) {
+	if l.MMDBSource != nil {
+		return l.MMDBSource.openMMDB()
 	}
 	if l.AutoDL {
 		if !l.shouldDownload(filename) {
 			m, err := NewIPInstance(filename)
 			if err == nil {
-				l.ipreader = m
 				return m, nil
 			}
-			// file is broken, download it again
+			// file is broken, download it again from scratch
+			_ = os.Remove(filename)
 		}
-		err := l.downloadAndCheck(filename, downUrl, func(filename string) error {
-			return nil
-		})
+		_, err := l.downloadMMDB(ctx, filename)
 		if err != nil {
 			// as long as the previous download exists, fallback to it
 			if _, serr := os.Stat(filename); os.IsNotExist(serr) {
@@ -180,12 +740,218 @@ func (l *GeoLoaderT) LoadGeoMMDB() (*IPReader, error) {
 			}
 		}
 	}
-	m, err := NewIPInstance(filename)
+	return NewIPInstance(filename)
+}
+
+func (l *GeoLoaderT) downloadMMDB(ctx context.Context, filename string) (bool, error) {
+	downUrl := l.MmdbURL
+	if downUrl == "" {
+		downUrl = mmdbURL
+	}
+	return l.downloadAndCheck(ctx, filename, downUrl, geoChecksum{l.MMDBSHA256, l.MMDBSHA256URL}, checkMMDB)
+}
+
+// OnGeoSiteUpdate implements GeoUpdateNotifier.
+func (l *GeoLoaderT) OnGeoSiteUpdate(name string, fn func(*v2geo.Set)) func() {
+	l.notifyLock.Lock()
+	defer l.notifyLock.Unlock()
+	if l.geositeWatchers == nil {
+		l.geositeWatchers = make(map[string]map[uint64]func(*v2geo.Set))
+	}
+	if l.geositeWatchers[name] == nil {
+		l.geositeWatchers[name] = make(map[uint64]func(*v2geo.Set))
+	}
+	l.notifyID++
+	id := l.notifyID
+	l.geositeWatchers[name][id] = fn
+	return func() {
+		l.notifyLock.Lock()
+		defer l.notifyLock.Unlock()
+		delete(l.geositeWatchers[name], id)
+		if len(l.geositeWatchers[name]) == 0 {
+			delete(l.geositeWatchers, name)
+		}
+	}
+}
+
+// OnUpdate implements GeoUpdateNotifier.
+func (l *GeoLoaderT) OnUpdate(fn func()) func() {
+	l.notifyLock.Lock()
+	defer l.notifyLock.Unlock()
+	if l.updateFuncs == nil {
+		l.updateFuncs = make(map[uint64]func())
+	}
+	l.notifyID++
+	id := l.notifyID
+	l.updateFuncs[id] = fn
+	return func() {
+		l.notifyLock.Lock()
+		defer l.notifyLock.Unlock()
+		delete(l.updateFuncs, id)
+	}
+}
+
+// Start keeps the downloaded databases up to date in the background until ctx
+// is done. Only the databases that have been loaded are updated, and rules
+// compiled with this loader switch to the new data without recompiling.
+// Requires AutoDL.
+func (l *GeoLoaderT) Start(ctx context.Context) {
+	interval := min(l.updateInterval(), geoUpdateCheckInterval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = l.Update(ctx)
+			}
+		}
+	}()
+}
+
+// Update downloads the databases in use that are older than UpdateInterval,
+// and swaps them in. MMDBOverrideFile is reloaded if it changed, even without
+// AutoDL. Returns nil if there was nothing to do.
+func (l *GeoLoaderT) Update(ctx context.Context) error {
+	if !l.AutoDL && l.MMDBOverrideFile == "" {
+		return nil
+	}
+	_, err := l.updateFlight.do(ctx, "", func(ctx context.Context) (bool, error) {
+		return true, l.update(ctx)
+	})
+	return err
+}
+
+func (l *GeoLoaderT) update(ctx context.Context) error {
+	var (
+		mmdbUpdated         bool
+		sets                map[string]*v2geo.Set
+		mmdbErr, geositeErr error
+	)
+	if l.AutoDL {
+		mmdbUpdated, mmdbErr = l.updateMMDB(ctx)
+		sets, geositeErr = l.updateGeoSite(ctx)
+	}
+	overridesUpdated, overridesErr := l.updateMMDBOverrides()
+
+	l.notifyLock.Lock()
+	var fns []func()
+	if mmdbUpdated || overridesUpdated || len(sets) > 0 {
+		fns = slices.Collect(maps.Values(l.updateFuncs))
+	}
+	var watchers []func()
+	for name, set := range sets {
+		for _, fn := range l.geositeWatchers[name] {
+			watchers = append(watchers, func() { fn(set) })
+		}
+	}
+	l.notifyLock.Unlock()
+
+	for _, fn := range watchers {
+		fn()
+	}
+	for _, fn := range fns {
+		fn()
+	}
+	return errors.Join(mmdbErr, geositeErr, overridesErr)
+}
+
+// updateMMDBOverrides reloads MMDBOverrideFile if it changed. The old
+// overrides stay in use if the new file can't be loaded.
+func (l *GeoLoaderT) updateMMDBOverrides() (bool, error) {
+	l.mmdbLock.Lock()
+	r := l.ipreader
+	l.mmdbLock.Unlock()
+	if r == nil || l.MMDBOverrideFile == "" {
+		return false, nil
+	}
+	info, err := os.Stat(l.MMDBOverrideFile)
+	if err != nil {
+		return false, err
+	}
+	if old := r.overrides.Load(); old != nil && !old.changed(info) {
+		return false, nil
+	}
+	o, err := loadIPOverrides(l.MMDBOverrideFile)
+	if err != nil {
+		return false, err
+	}
+	r.overrides.Store(o)
+	return true, nil
+}
+
+func (l *GeoLoaderT) updateMMDB(ctx context.Context) (bool, error) {
+	filename := l.MMDBFilename
+	if filename == "" {
+		filename = mmdbFilename
+	}
+	l.mmdbLock.Lock()
+	r := l.ipreader
+	l.mmdbLock.Unlock()
+	if r == nil || l.MMDBSource != nil || !l.shouldDownload(filename) {
+		return false, nil
+	}
+	if updated, err := l.downloadMMDB(ctx, filename); !updated {
+		return false, err
+	}
+	mmdb, err := maxminddb.Open(filename)
 	if err != nil {
+		return false, err
+	}
+	r.swap(mmdb)
+	return true, nil
+}
+
+// updateGeoSite returns the categories that were rebuilt.
+func (l *GeoLoaderT) updateGeoSite(ctx context.Context) (map[string]*v2geo.Set, error) {
+	filename := l.GeoSiteFilename
+	if filename == "" {
+		filename = geositeFilename
+	}
+	l.geositeLock.Lock()
+	loaded := l.geositeIndex != nil
+	l.geositeLock.Unlock()
+	if !loaded || l.GeoSiteSource != nil || !l.shouldDownload(filename) {
+		return nil, nil
+	}
+	if updated, err := l.downloadGeoSite(ctx, filename); !updated {
 		return nil, err
 	}
-	l.ipreader = m
-	return m, nil
+	x, err := v2geo.OpenGeoSiteIndex(filename)
+	if err != nil {
+		return nil, err
+	}
+	l.geositeLock.Lock()
+	old := l.geositeIndex
+	l.geositeIndex = x
+	l.geositeGen++
+	names := slices.Collect(maps.Keys(l.geositeSets))
+	l.geositeLock.Unlock()
+	_ = old.Close()
+
+	// The old Sets are not closed, as matches may still be using them. Their
+	// mappings are released once they are garbage collected.
+	sets := make(map[string]*v2geo.Set, len(names))
+	var errs []error
+	for _, name := range names {
+		set, err := l.storeGeoSiteSet(ctx, name)
+		if err != nil {
+			// keep the old one
+			errs = append(errs, err)
+			continue
+		}
+		if set == nil {
+			// The category is gone, match nothing rather than stale data.
+			set = v2geo.NewSet(nil)
+			l.geositeLock.Lock()
+			l.geositeSets[name] = set
+			l.geositeLock.Unlock()
+		}
+		sets[name] = set
+	}
+	return sets, errors.Join(errs...)
 }
 
 func NewIPInstance(mmdbPath string) (*IPReader, error) {
@@ -193,16 +959,13 @@ func NewIPInstance(mmdbPath string) (*IPReader, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &IPReader{Reader: mmdb}, nil
+	return newIPReader(mmdb), nil
 }
 
 func (l *GeoLoaderT) CloseMMdb() {
-	l.lock.Lock()
-	defer l.lock.Unlock()
+	l.mmdbLock.Lock()
+	defer l.mmdbLock.Unlock()
 	if l.ipreader != nil {
-		l.ipreader.lock.Lock()
-		defer l.ipreader.lock.Unlock()
-		l.ipreader.close = true
-		l.ipreader.Close()
+		_ = l.ipreader.Close()
 	}
 }
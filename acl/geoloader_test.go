@@ -0,0 +1,516 @@
+package acl
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/belowLevel/route_rule/acl/v2geo"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseSHA256Sum(t *testing.T) {
+	a := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	b := "60303ae22b998861bce3b28f33eec1be758a213c86c93c076dbe9f558c11c752"
+
+	sum, err := parseSHA256Sum(a+"  geosite.dat\n", "geosite.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, a, sum)
+
+	// A single digest is used whatever the file name.
+	sum, err = parseSHA256Sum(a+"\n", "geosite.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, a, sum)
+
+	sum, err = parseSHA256Sum(a+"  geoip.dat\n"+b+" *geosite.dat\n", "geosite.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, b, sum)
+
+	_, err = parseSHA256Sum(a+"  geoip.dat\n"+b+"  country.mmdb\n", "geosite.dat")
+	assert.Error(t, err)
+	_, err = parseSHA256Sum("not a digest\n", "geosite.dat")
+	assert.Error(t, err)
+}
+
+func TestDownloadAndCheckSHA256(t *testing.T) {
+	t.Chdir(t.TempDir())
+	content := []byte("geo data")
+	h := sha256.Sum256(content)
+	digest := hex.EncodeToString(h[:])
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/geosite.dat", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	})
+	mux.HandleFunc("/geosite.dat.sha256sum", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(digest + "  geosite.dat\n"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var errs []error
+	l := &GeoLoaderT{
+		OnDownload: func(ev DownloadEvent) {
+			if ev.Err != nil {
+				errs = append(errs, ev.Err)
+			}
+		},
+	}
+	noCheck := func(string) error { return nil }
+	filename := "geosite.dat"
+
+	_, err := l.downloadAndCheck(context.Background(), filename, srv.URL+"/geosite.dat", geoChecksum{SHA256: digest}, noCheck)
+	assert.NoError(t, err)
+	bs, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, bs)
+	assert.NoError(t, os.Remove(filename))
+
+	_, err = l.downloadAndCheck(context.Background(), filename, srv.URL+"/geosite.dat", geoChecksum{SHA256URL: srv.URL + "/geosite.dat.sha256sum"}, noCheck)
+	assert.NoError(t, err)
+	assert.FileExists(t, filename)
+	assert.NoError(t, os.Remove(filename))
+	assert.Empty(t, errs)
+
+	// A mismatching download is discarded, and the existing file is kept.
+	assert.NoError(t, os.WriteFile(filename, []byte("old"), 0o644))
+	_, err = l.downloadAndCheck(context.Background(), filename, srv.URL+"/geosite.dat", geoChecksum{SHA256: "00" + digest[2:]}, noCheck)
+	assert.Error(t, err)
+	assert.Len(t, errs, 1)
+	bs, _ = os.ReadFile(filename)
+	assert.Equal(t, []byte("old"), bs)
+
+	_, err = l.downloadAndCheck(context.Background(), filename, srv.URL+"/missing", geoChecksum{}, noCheck)
+	assert.Error(t, err)
+
+	tmps, _ := filepath.Glob("*" + geoPartSuffix)
+	assert.Empty(t, tmps)
+}
+
+func TestDownloadConditionalResume(t *testing.T) {
+	t.Chdir(t.TempDir())
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	modTime := time.Now().Add(-24 * time.Hour)
+	var ranges, fulls, notModified atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		rec := &statusRecorder{ResponseWriter: w}
+		http.ServeContent(rec, r, "geosite.dat", modTime, bytes.NewReader(content))
+		switch rec.status {
+		case http.StatusPartialContent:
+			ranges.Add(1)
+		case http.StatusNotModified:
+			notModified.Add(1)
+		default:
+			fulls.Add(1)
+		}
+	}))
+	defer srv.Close()
+
+	l := &GeoLoaderT{}
+	noCheck := func(string) error { return nil }
+	filename := "geosite.dat"
+
+	// An interrupted download of the same version is resumed.
+	assert.NoError(t, os.WriteFile(filename+geoPartSuffix, content[:10], 0o644))
+	assert.NoError(t, writeGeoMeta(filename, geoMeta{PartETag: `"v1"`}))
+	updated, err := l.downloadAndCheck(context.Background(), filename, srv.URL, geoChecksum{}, noCheck)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	bs, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, content, bs)
+	assert.EqualValues(t, 1, ranges.Load())
+	assert.NoFileExists(t, filename+geoPartSuffix)
+	assert.Equal(t, geoMeta{ETag: `"v1"`, LastModified: modTime.UTC().Format(http.TimeFormat)}, readGeoMeta(filename))
+
+	// Unchanged on the server, only the check time is recorded. The mtime
+	// is kept, and the checksum isn't fetched without a body to check.
+	old := time.Now().Add(-48 * time.Hour)
+	assert.NoError(t, os.Chtimes(filename, old, old))
+	updated, err = l.downloadAndCheck(context.Background(), filename, srv.URL, geoChecksum{SHA256URL: srv.URL + "/sum"}, noCheck)
+	assert.NoError(t, err)
+	assert.False(t, updated)
+	assert.EqualValues(t, 1, notModified.Load())
+	assert.EqualValues(t, 0, fulls.Load())
+	assert.False(t, l.shouldDownload(filename))
+	info, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, old.Unix(), info.ModTime().Unix())
+
+	// A part of another version is thrown away.
+	assert.NoError(t, os.WriteFile(filename+geoPartSuffix, []byte("stale"), 0o644))
+	assert.NoError(t, writeGeoMeta(filename, geoMeta{PartETag: `"v0"`}))
+	updated, err = l.downloadAndCheck(context.Background(), filename, srv.URL, geoChecksum{}, noCheck)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	bs, _ = os.ReadFile(filename)
+	assert.Equal(t, content, bs)
+	assert.EqualValues(t, 1, fulls.Load())
+
+	// Without the file, the validators aren't sent.
+	assert.NoError(t, os.Remove(filename))
+	updated, err = l.downloadAndCheck(context.Background(), filename, srv.URL, geoChecksum{}, noCheck)
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	assert.EqualValues(t, 2, fulls.Load())
+	assert.EqualValues(t, 1, notModified.Load())
+}
+
+func TestOpenBrokenGeoSite(t *testing.T) {
+	t.Chdir(t.TempDir())
+	content := testGeoSiteFile(t, "google.com")
+	var fulls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		rec := &statusRecorder{ResponseWriter: w}
+		http.ServeContent(rec, r, "geosite.dat", time.Now(), bytes.NewReader(content))
+		if rec.status != http.StatusNotModified {
+			fulls.Add(1)
+		}
+	}))
+	defer srv.Close()
+
+	// A broken file is downloaded again, even though the server has no news.
+	assert.NoError(t, os.WriteFile(geositeFilename, []byte("broken"), 0o644))
+	assert.NoError(t, writeGeoMeta(geositeFilename, geoMeta{ETag: `"v1"`}))
+	l := &GeoLoaderT{GeositeURL: srv.URL, AutoDL: true, UpdateInterval: time.Hour}
+	set, err := l.LoadGeoSiteSet(context.Background(), "google")
+	assert.NoError(t, err)
+	assert.True(t, set.Has("google.com"))
+	assert.EqualValues(t, 1, fulls.Load())
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func TestCheckMMDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "country.mmdb")
+	assert.NoError(t, os.WriteFile(file, []byte("<html>not found</html>"), 0o644))
+	assert.Error(t, checkMMDB(file))
+}
+
+func testGeoSiteFile(t *testing.T, domains ...string) []byte {
+	site := &v2geo.GeoSite{CountryCode: "GOOGLE"}
+	for _, d := range domains {
+		site.Domain = append(site.Domain, &v2geo.Domain{Type: v2geo.Domain_RootDomain, Value: d})
+	}
+	bs, err := proto.Marshal(&v2geo.GeoSiteList{Entry: []*v2geo.GeoSite{site}})
+	assert.NoError(t, err)
+	return bs
+}
+
+func TestGeoLoaderUpdate(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var data atomic.Pointer[[]byte]
+	bs := testGeoSiteFile(t, "google.com")
+	data.Store(&bs)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(*data.Load())
+	}))
+	defer srv.Close()
+
+	l := &GeoLoaderT{
+		GeositeURL:     srv.URL,
+		AutoDL:         true,
+		UpdateInterval: time.Hour,
+		CacheDir:       "cache",
+	}
+	rs, err := CompileWithOptions([]TextRule{
+		{Outbound: "test", Address: "geosite:google", ProtoPort: "*", Txt: "test(geosite:google)"},
+	}, map[string]*testOutbound{"test": {"test"}}, CompileOptions{CacheSize: 16, GeoLoader: l})
+	assert.NoError(t, err)
+
+	match := func(host string) bool {
+		return rs.Match(&AddrEx{Host: host, HostInfo: &HostInfo{}}) != nil
+	}
+	assert.True(t, match("www.google.com"))
+	assert.False(t, match("www.youtube.com"))
+
+	bs = testGeoSiteFile(t, "google.com", "youtube.com")
+	data.Store(&bs)
+	// Not due yet.
+	assert.NoError(t, l.Update(context.Background()))
+	assert.False(t, match("www.youtube.com"))
+
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(geositeFilename, old, old))
+	assert.NoError(t, l.Update(context.Background()))
+	// The cached miss is gone along with the old data.
+	assert.True(t, match("www.youtube.com"))
+	assert.True(t, match("www.google.com"))
+
+	set, err := l.LoadGeoSiteSet(context.Background(), "google")
+	assert.NoError(t, err)
+	assert.True(t, set.Has("youtube.com"))
+}
+
+func TestGeoLoaderUpdateNotModified(t *testing.T) {
+	t.Chdir(t.TempDir())
+	content := testGeoSiteFile(t, "google.com")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "geosite.dat", time.Now(), bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	l := &GeoLoaderT{GeositeURL: srv.URL, AutoDL: true, UpdateInterval: time.Hour}
+	set, err := l.LoadGeoSiteSet(context.Background(), "google")
+	assert.NoError(t, err)
+	var updates atomic.Int32
+	l.OnUpdate(func() { updates.Add(1) })
+
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(geositeFilename, old, old))
+	assert.NoError(t, l.Update(context.Background()))
+	assert.Zero(t, updates.Load())
+	assert.False(t, l.shouldDownload(geositeFilename))
+	same, err := l.LoadGeoSiteSet(context.Background(), "google")
+	assert.NoError(t, err)
+	assert.Same(t, set, same)
+}
+
+func TestGeoLoaderUpdateDuringLoad(t *testing.T) {
+	oldData := testGeoSiteFile(t, "google.com")
+	newData := testGeoSiteFile(t, "google.com", "youtube.com")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(newData)
+	}))
+	defer srv.Close()
+
+	for range 20 {
+		filename := filepath.Join(t.TempDir(), "geosite.dat")
+		assert.NoError(t, os.WriteFile(filename, oldData, 0o644))
+		l := &GeoLoaderT{
+			GeositeURL:      srv.URL,
+			GeoSiteFilename: filename,
+			AutoDL:          true,
+			UpdateInterval:  time.Hour,
+		}
+		_, err := l.loadGeoSiteIndex(context.Background())
+		assert.NoError(t, err)
+		old := time.Now().Add(-2 * time.Hour)
+		assert.NoError(t, os.Chtimes(filename, old, old))
+
+		// The first load of a category races with the update, the
+		// category must end up with the new data either way.
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, l.Update(context.Background()))
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := l.LoadGeoSiteSet(context.Background(), "google")
+			assert.NoError(t, err)
+		}()
+		wg.Wait()
+		set, err := l.LoadGeoSiteSet(context.Background(), "google")
+		assert.NoError(t, err)
+		assert.True(t, set.Has("youtube.com"))
+	}
+}
+
+func TestGeoLoaderRecompile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	bs := testGeoSiteFile(t, "google.com")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bs)
+	}))
+	defer srv.Close()
+
+	l := &GeoLoaderT{
+		GeositeURL:     srv.URL,
+		AutoDL:         true,
+		UpdateInterval: time.Hour,
+		CacheDir:       "cache",
+	}
+	compile := func() CompiledRuleSet[*testOutbound] {
+		rs, err := CompileWithOptions([]TextRule{
+			{Outbound: "test", Address: "geosite:google", ProtoPort: "*", Txt: "test(geosite:google)"},
+		}, map[string]*testOutbound{"test": {"test"}}, CompileOptions{CacheSize: 16, GeoLoader: l})
+		assert.NoError(t, err)
+		return rs
+	}
+	rs := compile()
+	for range 3 {
+		next := compile()
+		assert.NoError(t, rs.Close())
+		rs = next
+		assert.Len(t, l.updateFuncs, 1)
+		assert.Len(t, l.geositeWatchers["google"], 1)
+	}
+	assert.NotNil(t, rs.Match(&AddrEx{Host: "www.google.com", HostInfo: &HostInfo{}}))
+	assert.NoError(t, rs.Close())
+	assert.Empty(t, l.updateFuncs)
+	assert.Empty(t, l.geositeWatchers)
+}
+
+func TestGeoSiteSetCache(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "geosite.dat")
+	cacheDir := filepath.Join(dir, "cache")
+	load := func() *v2geo.Set {
+		l := &GeoLoaderT{GeoSiteFilename: filename, CacheDir: cacheDir}
+		set, err := l.LoadGeoSiteSet(context.Background(), "google")
+		assert.NoError(t, err)
+		return set
+	}
+
+	assert.NoError(t, os.WriteFile(filename, testGeoSiteFile(t, "google.com"), 0o644))
+	assert.False(t, load().Has("youtube.com"))
+	assert.FileExists(t, filepath.Join(cacheDir, "google.sskv"))
+	assert.False(t, load().Has("youtube.com"))
+
+	// Replaced by a file that looks older than the cache.
+	assert.NoError(t, os.WriteFile(filename, testGeoSiteFile(t, "google.com", "youtube.com"), 0o644))
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(filename, old, old))
+	assert.True(t, load().Has("youtube.com"))
+}
+
+type dialOutbound struct {
+	testOutbound
+	dials atomic.Int32
+}
+
+func (o *dialOutbound) TCP(ctx context.Context, reqAddr *AddrEx) (net.Conn, error) {
+	o.dials.Add(1)
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", reqAddr.String())
+}
+
+func TestDownloadThroughOutbound(t *testing.T) {
+	t.Chdir(t.TempDir())
+	var ua atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ua.Store(r.UserAgent())
+		_, _ = w.Write([]byte("geo data"))
+	}))
+	defer srv.Close()
+
+	ob := &dialOutbound{testOutbound: testOutbound{"socks5"}}
+	l := &GeoLoaderT{
+		Outbound:  ob,
+		UserAgent: "geoloader-test/1.0",
+	}
+	noCheck := func(string) error { return nil }
+	_, err := l.downloadAndCheck(context.Background(), "geosite.dat", srv.URL, geoChecksum{}, noCheck)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, ob.dials.Load())
+	assert.Equal(t, "geoloader-test/1.0", ua.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = l.downloadAndCheck(ctx, "geosite.dat", srv.URL, geoChecksum{}, noCheck)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	t.Chdir(t.TempDir())
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	l := &GeoLoaderT{
+		DownloadTimeout: 50 * time.Millisecond,
+	}
+	_, err := l.downloadAndCheck(context.Background(), "geosite.dat", srv.URL, geoChecksum{}, func(string) error { return nil })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NoFileExists(t, "geosite.dat")
+}
+
+func TestGeoLoaderSeparateDownloads(t *testing.T) {
+	t.Chdir(t.TempDir())
+	mux := http.NewServeMux()
+	// The geosite download hangs until its caller gives up.
+	mux.HandleFunc("/geosite.dat", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	var events []DownloadEvent
+	var mu sync.Mutex
+	l := &GeoLoaderT{
+		GeositeURL: srv.URL + "/geosite.dat",
+		MmdbURL:    srv.URL + "/country.mmdb",
+		AutoDL:     true,
+		OnDownload: func(ev DownloadEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events = append(events, ev)
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := l.LoadGeoSiteSet(ctx, "google")
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// An MMDB load doesn't wait for the geosite download.
+	_, err := l.LoadGeoMMDB(context.Background())
+	assert.ErrorContains(t, err, "404")
+
+	cancel()
+	assert.ErrorIs(t, <-errc, context.Canceled)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events) == 4
+	}, time.Second, 10*time.Millisecond)
+	// MMDB started and finished while geosite was in progress.
+	assert.Equal(t, geositeFilename, events[0].Filename)
+	assert.Equal(t, mmdbFilename, events[2].Filename)
+	assert.True(t, events[2].Done)
+	assert.Equal(t, geositeFilename, events[3].Filename)
+	assert.ErrorIs(t, events[3].Err, context.Canceled)
+}
+
+func TestDownloadProgress(t *testing.T) {
+	t.Chdir(t.TempDir())
+	content := bytes.Repeat([]byte("x"), 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "geosite.dat", time.Now(), bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	var events []DownloadEvent
+	l := &GeoLoaderT{OnDownload: func(ev DownloadEvent) { events = append(events, ev) }}
+	_, err := l.downloadAndCheck(context.Background(), "geosite.dat", srv.URL, geoChecksum{}, func(string) error { return nil })
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(events), 3)
+	assert.Equal(t, DownloadEvent{Filename: "geosite.dat", URL: srv.URL, Total: -1}, events[0])
+	progress := events[len(events)-2]
+	assert.EqualValues(t, 1000, progress.Total)
+	assert.Positive(t, progress.Bytes)
+	assert.True(t, events[len(events)-1].Done)
+	assert.NoError(t, events[len(events)-1].Err)
+}
@@ -0,0 +1,88 @@
+package acl
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/belowLevel/route_rule/acl/v2geo"
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// GeoSource provides a geo database that the loader doesn't manage itself,
+// e.g. data baked into a firmware image. Exactly one of File, Bytes, ReaderAt
+// or FS should be set. Sources are never downloaded or updated.
+type GeoSource struct {
+	File string
+
+	Bytes []byte
+
+	// ReaderAt provides Size bytes of data. It must stay valid for as long
+	// as the loader is in use.
+	ReaderAt io.ReaderAt
+	Size     int64
+
+	// FS and Path name a file in a file system, such as an embed.FS.
+	FS   fs.FS
+	Path string
+}
+
+var errEmptyGeoSource = errors.New("empty geo source")
+
+// readAll returns the whole data of the source.
+func (s *GeoSource) readAll() ([]byte, error) {
+	switch {
+	case s.File != "":
+		return os.ReadFile(s.File)
+	case s.Bytes != nil:
+		return s.Bytes, nil
+	case s.ReaderAt != nil:
+		bs := make([]byte, s.Size)
+		n, err := s.ReaderAt.ReadAt(bs, 0)
+		if n == len(bs) {
+			// ReadAt may report io.EOF along with the last bytes.
+			return bs, nil
+		}
+		return nil, err
+	case s.FS != nil:
+		return fs.ReadFile(s.FS, s.Path)
+	}
+	return nil, errEmptyGeoSource
+}
+
+func (s *GeoSource) openGeoSiteIndex() (*v2geo.GeoSiteIndex, error) {
+	switch {
+	case s.File != "":
+		return v2geo.OpenGeoSiteIndex(s.File)
+	case s.Bytes != nil:
+		return v2geo.NewGeoSiteIndex(bytes.NewReader(s.Bytes), int64(len(s.Bytes)))
+	case s.ReaderAt != nil:
+		return v2geo.NewGeoSiteIndex(s.ReaderAt, s.Size)
+	case s.FS != nil:
+		return v2geo.OpenGeoSiteIndexFS(s.FS, s.Path)
+	}
+	return nil, errEmptyGeoSource
+}
+
+func (s *GeoSource) openMMDB() (*IPReader, error) {
+	if s.File != "" {
+		return NewIPInstance(s.File)
+	}
+	bs, err := s.readAll()
+	if err != nil {
+		return nil, err
+	}
+	return NewIPInstanceFromBytes(bs)
+}
+
+// NewIPInstanceFromBytes is like NewIPInstance, for an MMDB in memory.
+// bs must not be modified while the IPReader is in use.
+func NewIPInstanceFromBytes(bs []byte) (*IPReader, error) {
+	mmdb, err := maxminddb.OpenBytes(bs)
+	if err != nil {
+		return nil, err
+	}
+	return newIPReader(mmdb), nil
+}
@@ -0,0 +1,69 @@
+package acl
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPInstanceFromBytes(t *testing.T) {
+	r, err := NewIPInstanceFromBytes(testMMDB(t, map[string]any{
+		"1.0.0.0/8":     testCountry("US"),
+		"2.2.0.0/16":    testCountry("FR"),
+		"10.10.10.0/24": testCountry("CN"),
+	}))
+	assert.NoError(t, err)
+	defer r.Close()
+	assert.NoError(t, checkMMDBMetadata(r.Metadata()))
+	assert.Equal(t, []string{"us"}, r.LookupCode(net.ParseIP("1.2.3.4")))
+	assert.Equal(t, []string{"fr"}, r.LookupCode(net.ParseIP("2.2.255.1")))
+	assert.Equal(t, []string{"cn"}, r.LookupCode(net.ParseIP("10.10.10.10")))
+	assert.Empty(t, r.LookupCode(net.ParseIP("2.3.0.1")))
+}
+
+func TestGeoLoaderSources(t *testing.T) {
+	mmdb := testMMDB(t, map[string]any{"1.0.0.0/8": testCountry("US")})
+	geosite := testGeoSiteFile(t, "google.com")
+
+	sources := map[string]*GeoSource{
+		"bytes":    {Bytes: mmdb},
+		"readerAt": {ReaderAt: bytes.NewReader(mmdb), Size: int64(len(mmdb))},
+		"fs":       {FS: fstest.MapFS{"geo/country.mmdb": {Data: mmdb}}, Path: "geo/country.mmdb"},
+	}
+	for name, src := range sources {
+		t.Run(name, func(t *testing.T) {
+			// AutoDL is ignored for sources, nothing is downloaded.
+			l := &GeoLoaderT{AutoDL: true, MMDBSource: src, OnDownload: func(ev DownloadEvent) {
+				t.Errorf("unexpected download of %s", ev.Filename)
+			}}
+			r, err := l.LoadGeoMMDB(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"us"}, r.LookupCode(net.ParseIP("1.1.1.1")))
+			assert.NoError(t, l.Update(context.Background()))
+		})
+	}
+
+	siteSources := map[string]*GeoSource{
+		"bytes":    {Bytes: geosite},
+		"readerAt": {ReaderAt: bytes.NewReader(geosite), Size: int64(len(geosite))},
+		"fs":       {FS: fstest.MapFS{"geosite.dat": {Data: geosite}}, Path: "geosite.dat"},
+	}
+	for name, src := range siteSources {
+		t.Run("geosite-"+name, func(t *testing.T) {
+			l := &GeoLoaderT{AutoDL: true, GeoSiteSource: src, CacheDir: t.TempDir()}
+			set, err := l.LoadGeoSiteSet(context.Background(), "google")
+			assert.NoError(t, err)
+			assert.True(t, set.Has("www.google.com"))
+			set, err = l.LoadGeoSiteSet(context.Background(), "missing")
+			assert.NoError(t, err)
+			assert.Nil(t, set)
+		})
+	}
+
+	_, err := (&GeoSource{}).openMMDB()
+	assert.ErrorIs(t, err, errEmptyGeoSource)
+}
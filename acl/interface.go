@@ -3,6 +3,7 @@ package acl
 import (
 	"context"
 	"net"
+	"net/netip"
 	"strconv"
 )
 
@@ -24,6 +25,7 @@ type AddrEx struct {
 	Port     uint16
 	HostInfo *HostInfo // Only set if there's a resolver in the pipeline
 	Txt      string
+	Hit      string // Entry of the matched rule that hit, e.g. the domain suffix of a set
 	Proto    Protocol
 	ObName   string
 	Err      error
@@ -56,3 +58,19 @@ type Outbound interface {
 	UDP(reqAddr *AddrEx) (UDPConn, error)
 	GetName() string
 }
+
+// FakeIPMapper maps the synthetic addresses handed out by a fake-IP DNS server
+// back to their domains.
+type FakeIPMapper interface {
+	// Contains reports whether addr is in the range of synthetic addresses.
+	Contains(addr netip.Addr) bool
+	// LookupHost returns the domain addr was handed out for.
+	LookupHost(addr netip.Addr) (string, bool)
+}
+
+// FakeIPGuard is implemented by outbounds that connect to the addresses of
+// hosts themselves. The ACL engine hands them its FakeIPMapper, and they
+// refuse to connect to fake IPs, whoever resolved the host to them.
+type FakeIPGuard interface {
+	SetFakeIP(m FakeIPMapper)
+}
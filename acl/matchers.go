@@ -1,6 +1,7 @@
 package acl
 
 import (
+	"context"
 	"net"
 	"strings"
 
@@ -17,21 +18,29 @@ type hostMatcher interface {
 	Match(*AddrEx) bool
 }
 
+// contextHostMatcher is a hostMatcher that may resolve the host, which the
+// context bounds.
+type contextHostMatcher interface {
+	hostMatcher
+	MatchContext(context.Context, *AddrEx) bool
+}
+
 type ipMatcher struct {
-	IP net.IP
+	IP   net.IP
+	Mode AddrMatchMode
 }
 
 func (m *ipMatcher) Match(reqAddr *AddrEx) bool {
-
-	return m.IP.Equal(reqAddr.HostInfo.IPv4) || m.IP.Equal(reqAddr.HostInfo.IPv6)
+	return m.Mode.match(reqAddr.HostInfo.Addrs(), m.IP.Equal)
 }
 
 type cidrMatcher struct {
 	IPNet *net.IPNet
+	Mode  AddrMatchMode
 }
 
 func (m *cidrMatcher) Match(reqAddr *AddrEx) bool {
-	return m.IPNet.Contains(reqAddr.HostInfo.IPv4) || m.IPNet.Contains(reqAddr.HostInfo.IPv6)
+	return m.Mode.match(reqAddr.HostInfo.Addrs(), m.IPNet.Contains)
 }
 
 type domainMatcher struct {
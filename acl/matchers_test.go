@@ -1 +1,51 @@
 package acl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostInfoSetIPs(t *testing.T) {
+	var h HostInfo
+	assert.Empty(t, h.Addrs())
+	h.IPv6 = net.ParseIP("2001:db8::1")
+	assert.Equal(t, []net.IP{h.IPv6}, h.Addrs())
+
+	h.SetIPs([]ResolvedIP{
+		{IP: net.ParseIP("2001:db8::2"), TTL: time.Minute},
+		{IP: net.ParseIP("192.0.2.1"), TTL: time.Minute},
+		{IP: net.ParseIP("192.0.2.2"), TTL: time.Minute},
+	})
+	assert.Equal(t, "192.0.2.1", h.IPv4.String())
+	assert.Equal(t, "2001:db8::2", h.IPv6.String())
+	assert.Equal(t, []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("2001:db8::2"),
+	}, h.Addrs())
+	assert.Equal(t, time.Minute, h.IPs[0].TTL)
+}
+
+func TestAddrMatchMode(t *testing.T) {
+	h := &HostInfo{}
+	h.SetIPs([]ResolvedIP{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("198.51.100.1")},
+	})
+	reqAddr := &AddrEx{Host: "cdn.example", HostInfo: h}
+	_, ipnet, _ := net.ParseCIDR("198.51.100.0/24")
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+
+	// Only the first address used to be looked at.
+	assert.True(t, (&cidrMatcher{IPNet: ipnet}).Match(reqAddr))
+	assert.False(t, (&cidrMatcher{IPNet: ipnet, Mode: AddrMatchAll}).Match(reqAddr))
+	assert.True(t, (&cidrMatcher{IPNet: all, Mode: AddrMatchAll}).Match(reqAddr))
+	assert.True(t, (&ipMatcher{IP: net.ParseIP("198.51.100.1")}).Match(reqAddr))
+	assert.False(t, (&ipMatcher{IP: net.ParseIP("198.51.100.1"), Mode: AddrMatchAll}).Match(reqAddr))
+
+	// No addresses never match, not even all of them.
+	assert.False(t, (&cidrMatcher{IPNet: all, Mode: AddrMatchAll}).Match(&AddrEx{HostInfo: &HostInfo{}}))
+}
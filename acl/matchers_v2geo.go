@@ -1,56 +1,97 @@
 package acl
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/belowLevel/route_rule/acl/v2geo"
 	"net"
+	"net/netip"
 	"regexp"
+	"slices"
 	"strings"
 )
 
-var _ hostMatcher = (*geoipMatcher)(nil)
+var _ contextHostMatcher = (*geoipMatcher)(nil)
 
+type geoipField int
+
+const (
+	geoipCountry geoipField = iota
+	geoipContinent
+	geoipRegistered
+)
+
+// geoipMatcher matches one of:
+//
+//	us             country
+//	us-ca          subdivision of a country (ISO 3166-2)
+//	continent:eu   continent
+//	registered:de  country the network is registered in
 type geoipMatcher struct {
-	country  string
-	ipReader *IPReader
+	field       geoipField
+	code        string
+	subdivision string
+	ipReader    *IPReader
+	resolver    Resolver
+	mode        AddrMatchMode
 }
 
 func (m *geoipMatcher) matchIP(ip net.IP) bool {
 	if m.ipReader == nil {
 		return false
 	}
-	isos := m.ipReader.LookupCode(ip)
-	if len(isos) == 0 {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
 		return false
 	}
-	iso := isos[0]
-	if iso == m.country {
+	info := m.ipReader.LookupGeo(addr)
+	switch m.field {
+	case geoipContinent:
+		return info.Continent == m.code
+	case geoipRegistered:
+		return info.RegisteredCountry == m.code
+	}
+	if info.Country != m.code {
+		return false
+	}
+	if m.subdivision == "" {
 		return true
 	}
-	return false
+	return slices.Contains(info.Subdivisions, m.subdivision)
 }
 
 func (m *geoipMatcher) Match(reqAddr *AddrEx) bool {
+	return m.MatchContext(context.Background(), reqAddr)
+}
+
+func (m *geoipMatcher) MatchContext(ctx context.Context, reqAddr *AddrEx) bool {
 	if reqAddr.Err != nil {
 		return false
 	}
-	if reqAddr.HostInfo.IPv4 == nil {
-		localResolve(reqAddr)
-	}
-	if reqAddr.HostInfo.IPv4 != nil {
-		return m.matchIP(reqAddr.HostInfo.IPv4)
-	}
-	if reqAddr.HostInfo.IPv6 != nil {
-		return m.matchIP(reqAddr.HostInfo.IPv6)
+	if reqAddr.Resolve(ctx, m.resolver) != nil {
+		return false
 	}
-	return false
+	return m.mode.match(reqAddr.HostInfo.Addrs(), m.matchIP)
 }
 
-func newGeoIPMatcher(country string, ipReader *IPReader) (*geoipMatcher, error) {
-	return &geoipMatcher{
-		country:  country,
-		ipReader: ipReader,
-	}, nil
+func newGeoIPMatcher(code string, ipReader *IPReader) (*geoipMatcher, error) {
+	m := &geoipMatcher{ipReader: ipReader}
+	switch {
+	case strings.HasPrefix(code, "continent:"):
+		m.field, m.code = geoipContinent, code[len("continent:"):]
+	case strings.HasPrefix(code, "registered:"):
+		m.field, m.code = geoipRegistered, code[len("registered:"):]
+	default:
+		m.code, m.subdivision, _ = strings.Cut(code, "-")
+		if strings.Contains(code, "-") && m.subdivision == "" {
+			return nil, fmt.Errorf("empty GeoIP subdivision code: %s", code)
+		}
+	}
+	if m.code == "" {
+		return nil, fmt.Errorf("empty GeoIP code: %s", code)
+	}
+	return m, nil
 }
 
 var _ hostMatcher = (*geositeMatcher)(nil)
@@ -171,31 +212,3 @@ func domainAttributeToMap(attrs []*v2geo.Domain_Attribute) map[string]bool {
 	}
 	return m
 }
-
-func localResolve(reqAddr *AddrEx) {
-	ips, err := net.LookupIP(reqAddr.Host)
-	if err != nil {
-		reqAddr.Err = err
-		return
-	}
-	reqAddr.HostInfo.IPv4, reqAddr.HostInfo.IPv6 = splitIPv4IPv6(ips)
-}
-
-func splitIPv4IPv6(ips []net.IP) (ipv4, ipv6 net.IP) {
-	for _, ip := range ips {
-		if ip.To4() != nil {
-			if ipv4 == nil {
-				ipv4 = ip
-			}
-		} else {
-			if ipv6 == nil {
-				ipv6 = ip
-			}
-		}
-		if ipv4 != nil && ipv6 != nil {
-			// We have everything we need.
-			break
-		}
-	}
-	return ipv4, ipv6
-}
@@ -79,6 +79,59 @@ func Test_geoipMatcher_Match(t *testing.T) {
 	}
 }
 
+func Test_geoipMatcher_Region(t *testing.T) {
+	city := func(iso, registered, continent string, subdivisions ...string) map[string]any {
+		subs := make([]any, len(subdivisions))
+		for i, s := range subdivisions {
+			subs[i] = map[string]any{"iso_code": s}
+		}
+		return map[string]any{
+			"country":            map[string]any{"iso_code": iso},
+			"registered_country": map[string]any{"iso_code": registered},
+			"continent":          map[string]any{"code": continent},
+			"subdivisions":       subs,
+		}
+	}
+	reader, err := NewIPInstanceFromBytes(testMMDB(t, map[string]any{
+		"1.0.0.0/16": city("US", "US", "NA", "CA"),
+		"1.1.0.0/16": city("US", "US", "NA", "NY"),
+		"2.0.0.0/16": city("FR", "DE", "EU", "IDF", "75"),
+	}))
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	tests := []struct {
+		code string
+		ip   string
+		want bool
+	}{
+		{"us", "1.0.0.1", true},
+		{"us-ca", "1.0.0.1", true},
+		{"us-ca", "1.1.0.1", false},
+		{"us-ny", "1.1.0.1", true},
+		{"fr-75", "2.0.0.1", true},
+		{"fr-idf", "2.0.0.1", true},
+		{"de-75", "2.0.0.1", false},
+		{"continent:eu", "2.0.0.1", true},
+		{"continent:eu", "1.0.0.1", false},
+		{"continent:na", "1.1.0.1", true},
+		{"registered:de", "2.0.0.1", true},
+		{"registered:fr", "2.0.0.1", false},
+		{"fr", "2.0.0.1", true},
+	}
+	for _, tt := range tests {
+		m, err := newGeoIPMatcher(tt.code, reader)
+		assert.NoError(t, err)
+		got := m.Match(&AddrEx{HostInfo: &HostInfo{IPv4: net.ParseIP(tt.ip)}})
+		assert.Equal(t, tt.want, got, "%s %s", tt.code, tt.ip)
+	}
+
+	for _, code := range []string{"us-", "continent:", "registered:"} {
+		_, err := newGeoIPMatcher(code, reader)
+		assert.Error(t, err, code)
+	}
+}
+
 func Test_geositeMatcher_Match(t *testing.T) {
 	geositeMap, err := v2geo.LoadGeoSite("v2geo/geosite.dat")
 	assert.NoError(t, err)
@@ -0,0 +1,141 @@
+package acl
+
+import (
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"sort"
+	"testing"
+)
+
+// testMMDB builds a tiny IPv4 MaxMind DB, mapping each prefix to its record.
+// Records are made of map[string]any, string, uint32 and []any values.
+// Prefixes must not overlap.
+func testMMDB(t testing.TB, records map[string]any) []byte {
+	type node struct {
+		child [2]*node
+		data  int // offset in the data section, -1 for none
+	}
+	root := &node{data: -1}
+	var data []byte
+	prefixes := make([]string, 0, len(records))
+	for p := range records {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	for _, p := range prefixes {
+		prefix := netip.MustParsePrefix(p)
+		if !prefix.Addr().Is4() {
+			t.Fatalf("not an IPv4 prefix: %s", p)
+		}
+		ip := prefix.Addr().As4()
+		n := root
+		for i := 0; i < prefix.Bits(); i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if n.child[bit] == nil {
+				n.child[bit] = &node{data: -1}
+			}
+			n = n.child[bit]
+		}
+		n.data = len(data)
+		data = mmdbEncode(data, records[p])
+	}
+
+	// Number the inner nodes, the root first.
+	var nodes []*node
+	ids := make(map[*node]int)
+	var walk func(n *node)
+	walk = func(n *node) {
+		ids[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.child {
+			if c != nil && c.data < 0 {
+				walk(c)
+			}
+		}
+	}
+	walk(root)
+
+	count := len(nodes)
+	record := func(c *node) uint32 {
+		switch {
+		case c == nil:
+			return uint32(count)
+		case c.data >= 0:
+			return uint32(count + 16 + c.data)
+		default:
+			return uint32(ids[c])
+		}
+	}
+	var out []byte
+	for _, n := range nodes {
+		for _, c := range n.child {
+			r := record(c)
+			out = append(out, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	out = append(out, make([]byte, 16)...)
+	out = append(out, data...)
+	out = append(out, "\xab\xcd\xefMaxMind.com"...)
+	return mmdbEncode(out, map[string]any{
+		"node_count":                  uint32(count),
+		"record_size":                 uint32(24),
+		"ip_version":                  uint32(4),
+		"database_type":               "GeoLite2-Country",
+		"languages":                   []any{"en"},
+		"binary_format_major_version": uint32(2),
+		"binary_format_minor_version": uint32(0),
+		"build_epoch":                 uint32(0),
+		"description":                 map[string]any{"en": "test"},
+	})
+}
+
+// mmdbEncode appends v in the MaxMind DB data section format.
+func mmdbEncode(b []byte, v any) []byte {
+	ctrl := func(b []byte, typ byte, size int) []byte {
+		if size >= 29 {
+			panic("mmdb test values must be small")
+		}
+		if typ <= 7 {
+			return append(b, typ<<5|byte(size))
+		}
+		return append(b, byte(size), typ-7)
+	}
+	switch v := v.(type) {
+	case string:
+		return append(ctrl(b, 2, len(v)), v...)
+	case float64:
+		b = ctrl(b, 3, 8)
+		return binary.BigEndian.AppendUint64(b, math.Float64bits(v))
+	case uint32:
+		var bs []byte
+		for x := v; x > 0; x >>= 8 {
+			bs = append([]byte{byte(x)}, bs...)
+		}
+		return append(ctrl(b, 6, len(bs)), bs...)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = ctrl(b, 7, len(keys))
+		for _, k := range keys {
+			b = mmdbEncode(b, k)
+			b = mmdbEncode(b, v[k])
+		}
+		return b
+	case []any:
+		b = ctrl(b, 11, len(v))
+		for _, e := range v {
+			b = mmdbEncode(b, e)
+		}
+		return b
+	}
+	panic("unsupported mmdb test value")
+}
+
+// testCountry is a record as found in country databases.
+func testCountry(iso string) map[string]any {
+	return map[string]any{"country": map[string]any{"iso_code": iso}}
+}
@@ -0,0 +1,120 @@
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ipOverrides maps networks to countries, taking precedence over MMDBs.
+// It is read from a text file with one "CIDR country" pair per line, e.g.
+//
+//	# corrections
+//	203.0.113.0/24 jp
+//	2001:db8::/32  de
+//	198.51.100.7   us
+//
+// The most specific network wins. Only the country is overridden.
+type ipOverrides struct {
+	bits  []int // prefix lengths in use, longest first
+	infos map[netip.Prefix]*GeoInfo
+
+	// The file it was loaded from, to tell when it changes.
+	size    int64
+	modTime time.Time
+}
+
+func loadIPOverrides(filename string) (*ipOverrides, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	o, err := parseIPOverrides(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	o.size, o.modTime = info.Size(), info.ModTime()
+	return o, nil
+}
+
+// changed reports whether the file o was loaded from changed since.
+func (o *ipOverrides) changed(info os.FileInfo) bool {
+	return o.size != info.Size() || !o.modTime.Equal(info.ModTime())
+}
+
+func parseIPOverrides(r io.Reader) (*ipOverrides, error) {
+	o := &ipOverrides{infos: make(map[netip.Prefix]*GeoInfo)}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"CIDR country\"", lineNum)
+		}
+		prefix, err := parseOverridePrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		o.infos[prefix] = &GeoInfo{Country: strings.ToLower(fields[1])}
+		if !slices.Contains(o.bits, prefix.Bits()) {
+			o.bits = append(o.bits, prefix.Bits())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	slices.Sort(o.bits)
+	slices.Reverse(o.bits)
+	return o, nil
+}
+
+func parseOverridePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() {
+		if prefix.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("IPv4-mapped prefix %s is shorter than /96", s)
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// lookup returns the info of the most specific network containing addr.
+func (o *ipOverrides) lookup(addr netip.Addr) (*GeoInfo, bool) {
+	for _, bits := range o.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		p, _ := addr.Prefix(bits)
+		if info, ok := o.infos[p]; ok {
+			return info, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,137 @@
+package acl
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIPOverrides(t *testing.T) {
+	o, err := parseIPOverrides(strings.NewReader(`
+# corrections
+1.0.0.0/8    US
+1.2.3.0/24   jp # more specific
+1.2.3.4      cn
+2001:db8::/32 de
+::ffff:5.0.0.0/104 fr
+`))
+	assert.NoError(t, err)
+	tests := map[string]string{
+		"1.9.9.9":     "us",
+		"1.2.3.9":     "jp",
+		"1.2.3.4":     "cn",
+		"2001:db8::1": "de",
+		"5.1.1.1":     "fr",
+		"2.2.2.2":     "",
+		"2001:db9::1": "",
+	}
+	for ip, want := range tests {
+		info, ok := o.lookup(netip.MustParseAddr(ip))
+		if want == "" {
+			assert.False(t, ok, ip)
+			continue
+		}
+		assert.True(t, ok, ip)
+		assert.Equal(t, want, info.Country, ip)
+	}
+
+	_, err = parseIPOverrides(strings.NewReader("1.0.0.0/8\n"))
+	assert.ErrorContains(t, err, "line 1")
+	_, err = parseIPOverrides(strings.NewReader("\n1.0.0.0/33 us\n"))
+	assert.ErrorContains(t, err, "line 2")
+	_, err = parseIPOverrides(strings.NewReader("::ffff:0:0/80 us\n"))
+	assert.ErrorContains(t, err, "line 1")
+}
+
+func TestGeoLoaderMMDBLayers(t *testing.T) {
+	dir := t.TempDir()
+	free := filepath.Join(dir, "free.mmdb")
+	assert.NoError(t, os.WriteFile(free, testMMDB(t, map[string]any{
+		"1.0.0.0/8": testCountry("US"),
+		"2.0.0.0/8": testCountry("FR"),
+		"3.0.0.0/8": testCountry("GB"),
+	}), 0o644))
+	overrides := filepath.Join(dir, "override.txt")
+	assert.NoError(t, os.WriteFile(overrides, []byte("3.3.3.0/24 ie\n"), 0o644))
+
+	l := &GeoLoaderT{
+		MMDBFilename: free,
+		MMDBSources: []*GeoSource{
+			{Bytes: testMMDB(t, map[string]any{"1.0.0.0/8": testCountry("CA")})},
+			{Bytes: testMMDB(t, map[string]any{"1.0.0.0/8": testCountry("MX"), "2.0.0.0/8": testCountry("BE")})},
+		},
+		MMDBOverrideFile: overrides,
+	}
+	r, err := l.LoadGeoMMDB(context.Background())
+	assert.NoError(t, err)
+	defer r.Close()
+	tests := map[string]string{
+		"1.1.1.1": "ca", // first source wins
+		"2.2.2.2": "be", // second source
+		"3.1.1.1": "gb", // the loader's own database
+		"3.3.3.3": "ie", // override
+	}
+	for ip, want := range tests {
+		iso, ok := r.LookupCountry(netip.MustParseAddr(ip))
+		assert.True(t, ok, ip)
+		assert.Equal(t, want, iso, ip)
+	}
+	_, ok := r.LookupCountry(netip.MustParseAddr("4.4.4.4"))
+	assert.False(t, ok)
+
+	l = &GeoLoaderT{MMDBFilename: free, MMDBOverrideFile: filepath.Join(dir, "missing.txt")}
+	_, err = l.LoadGeoMMDB(context.Background())
+	assert.Error(t, err)
+}
+
+func TestGeoLoaderMMDBOverrideReload(t *testing.T) {
+	dir := t.TempDir()
+	free := filepath.Join(dir, "free.mmdb")
+	assert.NoError(t, os.WriteFile(free, testMMDB(t, map[string]any{
+		"3.0.0.0/8": map[string]any{
+			"country":            map[string]any{"iso_code": "GB"},
+			"registered_country": map[string]any{"iso_code": "GB"},
+			"continent":          map[string]any{"code": "EU"},
+			"subdivisions":       []any{map[string]any{"iso_code": "ENG"}},
+		},
+	}), 0o644))
+	overrides := filepath.Join(dir, "override.txt")
+	assert.NoError(t, os.WriteFile(overrides, []byte("3.3.3.0/24 ie\n"), 0o644))
+
+	l := &GeoLoaderT{MMDBFilename: free, MMDBOverrideFile: overrides}
+	r, err := l.LoadGeoMMDB(context.Background())
+	assert.NoError(t, err)
+	defer r.Close()
+	var updates int
+	l.OnUpdate(func() { updates++ })
+
+	// The rest comes from the database.
+	assert.Equal(t, &GeoInfo{Country: "ie", RegisteredCountry: "gb", Continent: "eu", Subdivisions: []string{"eng"}},
+		r.LookupGeo(netip.MustParseAddr("3.3.3.3")))
+
+	// Unchanged, nothing to do.
+	assert.NoError(t, l.Update(context.Background()))
+	assert.Zero(t, updates)
+
+	assert.NoError(t, os.WriteFile(overrides, []byte("3.3.3.0/24 fr\n3.4.0.0/16 de\n"), 0o644))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(overrides, later, later))
+	assert.NoError(t, l.Update(context.Background()))
+	assert.Equal(t, 1, updates)
+	iso, _ := r.LookupCountry(netip.MustParseAddr("3.3.3.3"))
+	assert.Equal(t, "fr", iso)
+	iso, _ = r.LookupCountry(netip.MustParseAddr("3.4.1.1"))
+	assert.Equal(t, "de", iso)
+
+	// A broken file keeps the old overrides.
+	assert.NoError(t, os.WriteFile(overrides, []byte("nonsense\n"), 0o644))
+	assert.Error(t, l.Update(context.Background()))
+	iso, _ = r.LookupCountry(netip.MustParseAddr("3.3.3.3"))
+	assert.Equal(t, "fr", iso)
+}
@@ -5,19 +5,89 @@ import (
 	"net"
 	"net/netip"
 	"strings"
-	"sync"
+	"sync/atomic"
 )
 
-type geoip2Country struct {
-	Country struct {
-		IsoCode string `maxminddb:"iso_code"`
-	} `maxminddb:"country"`
+const (
+	ipCacheSizeBits = 12
+	// ipCacheSize is the number of entries of the per-network result cache.
+	ipCacheSize = 1 << ipCacheSizeBits
+	// Results are cached per block of this many bits, for networks that span
+	// at least a whole block.
+	ipCacheBits4 = 24
+	ipCacheBits6 = 48
+)
+
+type geoip2Code struct {
+	IsoCode string `maxminddb:"iso_code"`
+}
+
+// geoip2Record holds the fields of Country and City databases we match on.
+type geoip2Record struct {
+	Country           geoip2Code   `maxminddb:"country"`
+	RegisteredCountry geoip2Code   `maxminddb:"registered_country"`
+	Subdivisions      []geoip2Code `maxminddb:"subdivisions"`
+	Continent         struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
 }
 
+// GeoInfo is what an MMDB knows about an address. All codes are lower case,
+// and empty if unknown.
+type GeoInfo struct {
+	Country           string   // ISO 3166-1 code, e.g. "us"
+	RegisteredCountry string   // country the network is registered in
+	Continent         string   // e.g. "eu"
+	Subdivisions      []string // ISO 3166-2 codes without the country, e.g. "ca", the largest first
+}
+
+func newGeoInfo(rec *geoip2Record) *GeoInfo {
+	info := &GeoInfo{
+		Country:           strings.ToLower(rec.Country.IsoCode),
+		RegisteredCountry: strings.ToLower(rec.RegisteredCountry.IsoCode),
+		Continent:         strings.ToLower(rec.Continent.Code),
+	}
+	for _, sub := range rec.Subdivisions {
+		if sub.IsoCode != "" {
+			info.Subdivisions = append(info.Subdivisions, strings.ToLower(sub.IsoCode))
+		}
+	}
+	return info
+}
+
+// emptyGeoInfo is returned for addresses that aren't in the database.
+var emptyGeoInfo = &GeoInfo{}
+
+// IPReader looks up the country of IP addresses in an MMDB. Lookups don't
+// block each other, and the database can be swapped out while they run: each
+// lookup holds a reference to the database it started on, and a database is
+// only closed once the last reference is gone.
+//
+// An IPReader may combine several databases: overrides come first, then the
+// layers in order, then its own database. The first one that knows an
+// address wins. Overrides only know countries, the rest of what is known
+// about an overridden address still comes from the databases.
 type IPReader struct {
-	*maxminddb.Reader
-	lock  sync.Mutex
-	close bool
+	db    atomic.Pointer[mmdbHandle]
+	cache [ipCacheSize]atomic.Pointer[ipCacheEntry]
+
+	// Reloaded by GeoLoaderT.Update.
+	overrides atomic.Pointer[ipOverrides]
+	// Set up before the IPReader is shared, read only afterwards.
+	layers []*IPReader
+}
+
+// mmdbHandle is a reference counted database. refs starts at 1 for the
+// IPReader itself, and the database is closed when it drops to 0.
+type mmdbHandle struct {
+	db   *maxminddb.Reader
+	refs atomic.Int64
+}
+
+type ipCacheEntry struct {
+	db    *mmdbHandle
+	block netip.Addr
+	info  *GeoInfo
 }
 
 type ASNReader struct {
@@ -29,20 +99,176 @@ type GeoLite2 struct {
 	AutonomousSystemOrganization string `maxminddb:"autonomous_system_organization"`
 }
 
-func (r *IPReader) LookupCode(ipAddress net.IP) []string {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	if r.close {
-		return []string{}
+func newIPReader(mmdb *maxminddb.Reader) *IPReader {
+	r := &IPReader{}
+	r.db.Store(newMMDBHandle(mmdb))
+	return r
+}
+
+func newMMDBHandle(mmdb *maxminddb.Reader) *mmdbHandle {
+	h := &mmdbHandle{db: mmdb}
+	h.refs.Store(1)
+	return h
+}
+
+// acquire returns the current database with a reference held,
+// or nil if the IPReader is closed.
+func (r *IPReader) acquire() *mmdbHandle {
+	for {
+		h := r.db.Load()
+		if h == nil {
+			return nil
+		}
+		n := h.refs.Load()
+		// A count of 0 means it was swapped out and closed in the meantime,
+		// so try again with the new one.
+		if n > 0 && h.refs.CompareAndSwap(n, n+1) {
+			return h
+		}
+	}
+}
+
+func (h *mmdbHandle) release() {
+	if h.refs.Add(-1) == 0 {
+		_ = h.db.Close()
+	}
+}
+
+// swap replaces the database with a newer one. The old one is closed once the
+// lookups in progress are done with it.
+func (r *IPReader) swap(mmdb *maxminddb.Reader) {
+	h := newMMDBHandle(mmdb)
+	for {
+		old := r.db.Load()
+		if old == nil {
+			// closed
+			_ = mmdb.Close()
+			return
+		}
+		if r.db.CompareAndSwap(old, h) {
+			old.release()
+			return
+		}
+	}
+}
+
+// Metadata returns the metadata of the current database.
+func (r *IPReader) Metadata() maxminddb.Metadata {
+	h := r.acquire()
+	if h == nil {
+		return maxminddb.Metadata{}
+	}
+	defer h.release()
+	return h.db.Metadata
+}
+
+// Close closes the IPReader and its layers, lookups return nothing from
+// then on.
+func (r *IPReader) Close() error {
+	if h := r.db.Swap(nil); h != nil {
+		h.release()
+	}
+	for _, layer := range r.layers {
+		_ = layer.Close()
+	}
+	return nil
+}
+
+// LookupCountry returns the lower case ISO code of the country of addr.
+// Results are cached per network, so repeated lookups in the same network
+// neither lock nor allocate.
+func (r *IPReader) LookupCountry(addr netip.Addr) (string, bool) {
+	info := r.LookupGeo(addr)
+	return info.Country, info.Country != ""
+}
+
+// LookupGeo returns what the databases know about addr, see LookupCountry.
+// The result is shared and must not be modified.
+func (r *IPReader) LookupGeo(addr netip.Addr) *GeoInfo {
+	// net.IP keeps IPv4 addresses in their 16 byte form, which an IPv4 only
+	// database doesn't know.
+	addr = addr.Unmap()
+	if !addr.IsValid() {
+		return emptyGeoInfo
+	}
+	if o := r.overrides.Load(); o != nil {
+		if override, ok := o.lookup(addr); ok {
+			info := *r.lookupDBs(addr)
+			info.Country = override.Country
+			return &info
+		}
+	}
+	return r.lookupDBs(addr)
+}
+
+// lookupDBs looks addr up in the layers and the own database of r.
+func (r *IPReader) lookupDBs(addr netip.Addr) *GeoInfo {
+	for _, layer := range r.layers {
+		if info := layer.lookupOwn(addr); info != emptyGeoInfo {
+			return info
+		}
 	}
-	var country geoip2Country
+	return r.lookupOwn(addr)
+}
+
+// lookupOwn looks addr up in the own database of r only.
+func (r *IPReader) lookupOwn(addr netip.Addr) *GeoInfo {
+	bits := ipCacheBits6
+	if addr.Is4() {
+		bits = ipCacheBits4
+	}
+	block, _ := addr.Prefix(bits)
+	slot := &r.cache[ipCacheSlot(block.Addr())]
+	cur := r.db.Load()
+	if e := slot.Load(); e != nil && e.db == cur && e.block == block.Addr() {
+		return e.info
+	}
+
+	h := r.acquire()
+	if h == nil {
+		return emptyGeoInfo
+	}
+	defer h.release()
+	result := h.db.Lookup(addr)
+	info := emptyGeoInfo
+	if result.Found() {
+		var rec geoip2Record
+		if result.Decode(&rec) == nil {
+			info = newGeoInfo(&rec)
+		}
+	}
+	if result.Err() == nil && result.Prefix().Bits() <= bits {
+		// The whole block is in this network.
+		slot.Store(&ipCacheEntry{db: h, block: block.Addr(), info: info})
+	}
+	return info
+}
+
+func ipCacheSlot(block netip.Addr) uint32 {
+	var x uint64
+	if block.Is4() {
+		b := block.As4()
+		x = uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	} else {
+		b := block.As16()
+		for _, c := range b[:6] {
+			x = x<<8 | uint64(c)
+		}
+	}
+	// Fibonacci hashing, so that neighbouring blocks spread out.
+	return uint32((x * 0x9E3779B97F4A7C15) >> (64 - ipCacheSizeBits))
+}
+
+// LookupCode is like LookupCountry, returning the code in a slice that is
+// empty if there is none.
+func (r *IPReader) LookupCode(ipAddress net.IP) []string {
 	netAddr, ok := netip.AddrFromSlice(ipAddress)
 	if !ok {
 		return []string{}
 	}
-	_ = r.Lookup(netAddr).Decode(&country)
-	if country.Country.IsoCode == "" {
+	country, ok := r.LookupCountry(netAddr)
+	if !ok {
 		return []string{}
 	}
-	return []string{strings.ToLower(country.Country.IsoCode)}
+	return []string{country}
 }
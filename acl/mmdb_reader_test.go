@@ -0,0 +1,109 @@
+package acl
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func testIPReader(t *testing.T, records map[string]any) (*IPReader, *maxminddb.Reader) {
+	db, err := maxminddb.OpenBytes(testMMDB(t, records))
+	assert.NoError(t, err)
+	return newIPReader(db), db
+}
+
+func TestIPReaderLookupCountry(t *testing.T) {
+	r, _ := testIPReader(t, map[string]any{
+		"1.0.0.0/8":     testCountry("US"),
+		"2.2.2.0/25":    testCountry("FR"),
+		"2.2.2.128/25":  testCountry("DE"),
+		"10.10.10.0/24": testCountry("CN"),
+	})
+	defer r.Close()
+
+	for i := 0; i < 2; i++ {
+		iso, ok := r.LookupCountry(netip.MustParseAddr("1.2.3.4"))
+		assert.True(t, ok)
+		assert.Equal(t, "us", iso)
+		iso, _ = r.LookupCountry(netip.MustParseAddr("::ffff:10.10.10.1"))
+		assert.Equal(t, "cn", iso)
+		// Networks smaller than a cache block must not be cached as a whole.
+		iso, _ = r.LookupCountry(netip.MustParseAddr("2.2.2.1"))
+		assert.Equal(t, "fr", iso)
+		iso, _ = r.LookupCountry(netip.MustParseAddr("2.2.2.200"))
+		assert.Equal(t, "de", iso)
+		_, ok = r.LookupCountry(netip.MustParseAddr("3.3.3.3"))
+		assert.False(t, ok)
+	}
+
+	addr := netip.MustParseAddr("1.9.9.9")
+	r.LookupCountry(addr)
+	allocs := testing.AllocsPerRun(100, func() {
+		r.LookupCountry(addr)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestIPReaderSwap(t *testing.T) {
+	r, db := testIPReader(t, map[string]any{"1.0.0.0/8": testCountry("US")})
+	iso, _ := r.LookupCountry(netip.MustParseAddr("1.1.1.1"))
+	assert.Equal(t, "us", iso)
+
+	// A lookup in progress keeps the old database open.
+	h := r.acquire()
+	db2, err := maxminddb.OpenBytes(testMMDB(t, map[string]any{"1.0.0.0/8": testCountry("JP")}))
+	assert.NoError(t, err)
+	r.swap(db2)
+	iso, _ = r.LookupCountry(netip.MustParseAddr("1.1.1.1"))
+	assert.Equal(t, "jp", iso, "new database used right away")
+	assert.True(t, h.db.Lookup(netip.MustParseAddr("1.1.1.1")).Found())
+	h.release()
+	assert.Error(t, db.Lookup(netip.MustParseAddr("1.1.1.1")).Err(), "old database closed")
+
+	assert.NoError(t, r.Close())
+	_, ok := r.LookupCountry(netip.MustParseAddr("1.1.1.1"))
+	assert.False(t, ok)
+	assert.Error(t, db2.Lookup(netip.MustParseAddr("1.1.1.1")).Err())
+}
+
+func TestIPReaderConcurrent(t *testing.T) {
+	r, _ := testIPReader(t, map[string]any{"1.0.0.0/8": testCountry("US")})
+	defer r.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				iso, ok := r.LookupCountry(netip.AddrFrom4([4]byte{1, byte(j), byte(i), 1}))
+				if !ok || (iso != "us" && iso != "jp") {
+					t.Errorf("unexpected lookup result %q", iso)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		db, err := maxminddb.OpenBytes(testMMDB(t, map[string]any{"1.0.0.0/8": testCountry("JP")}))
+		assert.NoError(t, err)
+		r.swap(db)
+	}
+	wg.Wait()
+}
+
+func BenchmarkIPReaderLookupCountry(b *testing.B) {
+	db, _ := maxminddb.OpenBytes(testMMDB(b, map[string]any{"1.0.0.0/8": testCountry("US")}))
+	r := newIPReader(db)
+	defer r.Close()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			r.LookupCountry(netip.AddrFrom4([4]byte{1, byte(i), byte(i >> 8), 1}))
+			i++
+		}
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/belowLevel/route_rule/acl"
 	"net"
+	"net/netip"
 	"strconv"
 	"time"
 )
@@ -32,7 +33,8 @@ const (
 // directOutbound is a PluggableOutbound that connects directly to the target
 // using the local network (as opposed to using a proxy, for example).
 // It prefers to use ResolveInfo in AddrEx if available. But if it's nil,
-// it will fall back to resolving Host using Go's built-in DNS resolver.
+// it will fall back to resolving Host using Resolver, or Go's built-in DNS
+// resolver if that is nil.
 type directOutbound struct {
 	Mode DirectOutboundMode
 
@@ -46,6 +48,10 @@ type directOutbound struct {
 	BindIP4    net.IP
 	BindIP6    net.IP
 	Name       string
+
+	Resolver acl.Resolver
+	// FakeIP, if set, is the range of addresses never to connect to.
+	FakeIP acl.FakeIPMapper
 }
 
 type DirectOutboundOptions struct {
@@ -56,6 +62,11 @@ type DirectOutboundOptions struct {
 	BindIP6    net.IP
 
 	FastOpen bool
+
+	// Resolver resolves hosts without addresses. Defaults to the system resolver.
+	Resolver acl.Resolver
+	// FakeIP, if set, makes connections to fake IPs fail, see acl.FakeIPGuard.
+	FakeIP acl.FakeIPMapper
 }
 
 type noAddressError struct {
@@ -97,6 +108,14 @@ func (e resolveError) Unwrap() error {
 	return e.Err
 }
 
+type fakeIPError struct {
+	IP net.IP
+}
+
+func (e fakeIPError) Error() string {
+	return "refusing to connect to fake IP " + e.IP.String()
+}
+
 func NewDirectOutboundWithOptions(opts DirectOutboundOptions) (acl.Outbound, error) {
 	dialer4 := &net.Dialer{
 		Timeout: defaultDialerTimeout,
@@ -139,6 +158,8 @@ func NewDirectOutboundWithOptions(opts DirectOutboundOptions) (acl.Outbound, err
 		DeviceName: opts.DeviceName,
 		BindIP4:    opts.BindIP4,
 		BindIP6:    opts.BindIP6,
+		Resolver:   opts.Resolver,
+		FakeIP:     opts.FakeIP,
 	}, nil
 }
 
@@ -178,19 +199,40 @@ func NewDirectOutboundBindToDevice(mode DirectOutboundMode, deviceName string) (
 }
 
 // resolve is our built-in DNS resolver for handling the case when
-// AddrEx.ResolveInfo is nil.
-func (d *directOutbound) resolve(reqAddr *acl.AddrEx) {
-	ips, err := net.LookupIP(reqAddr.Host)
-	if err != nil {
+// AddrEx.ResolveInfo is nil. It does nothing if the request was resolved
+// already, e.g. by a rule.
+func (d *directOutbound) resolve(ctx context.Context, reqAddr *acl.AddrEx) {
+	if err := reqAddr.Resolve(ctx, d.Resolver); err != nil {
 		reqAddr.Err = err
 		return
 	}
-	reqAddr.HostInfo.IPv4, reqAddr.HostInfo.IPv4 = splitIPv4IPv6(ips)
 	if reqAddr.HostInfo.IPv4 == nil && reqAddr.HostInfo.IPv6 == nil {
 		reqAddr.Err = noAddressError{IPv4: true, IPv6: true}
+		return
+	}
+	if err := d.checkFakeIP(reqAddr); err != nil {
+		reqAddr.Err = err
 	}
 }
 
+// checkFakeIP fails if any address of the request is a fake IP.
+func (d *directOutbound) checkFakeIP(reqAddr *acl.AddrEx) error {
+	if d.FakeIP == nil {
+		return nil
+	}
+	for _, ip := range reqAddr.HostInfo.Addrs() {
+		if addr, ok := netip.AddrFromSlice(ip); ok && d.FakeIP.Contains(addr.Unmap()) {
+			return fakeIPError{IP: ip}
+		}
+	}
+	return nil
+}
+
+// SetFakeIP implements acl.FakeIPGuard.
+func (d *directOutbound) SetFakeIP(m acl.FakeIPMapper) {
+	d.FakeIP = m
+}
+
 func (d *directOutbound) TCP(ctx context.Context, reqAddr *acl.AddrEx) (conn net.Conn, err error) {
 	defer func() {
 		if err == nil {
@@ -198,6 +240,54 @@ func (d *directOutbound) TCP(ctx context.Context, reqAddr *acl.AddrEx) (conn net
 			reqAddr.ConnIp = remoteIp
 		}
 	}()
+	if reqAddr.HostInfo == nil {
+		reqAddr.HostInfo = &acl.HostInfo{}
+	}
+	// With FakeIP, the addresses have to be known before dialing.
+	if d.Resolver != nil || d.FakeIP != nil || reqAddr.HostInfo.Resolved() {
+		d.resolve(ctx, reqAddr)
+		if reqAddr.Err != nil {
+			return nil, resolveError{Err: reqAddr.Err}
+		}
+	}
+	ipv4, ipv6 := splitIPFamilies(reqAddr.HostInfo.Addrs())
+	if len(ipv4) == 0 && len(ipv6) == 0 {
+		// Nothing resolved, leave it to the dialer.
+		return d.dialHostTCP(ctx, reqAddr)
+	}
+	switch d.Mode {
+	case DirectOutboundModeAuto:
+		if len(ipv4) > 0 && len(ipv6) > 0 {
+			return d.dualStackDialTCP(ctx, ipv4, ipv6, reqAddr.Port)
+		}
+		return d.dialTCPAddrs(ctx, append(ipv4, ipv6...), reqAddr.Port)
+	case DirectOutboundMode64:
+		if len(ipv6) > 0 {
+			return d.dialTCPAddrs(ctx, ipv6, reqAddr.Port)
+		}
+		return d.dialTCPAddrs(ctx, ipv4, reqAddr.Port)
+	case DirectOutboundMode46:
+		if len(ipv4) > 0 {
+			return d.dialTCPAddrs(ctx, ipv4, reqAddr.Port)
+		}
+		return d.dialTCPAddrs(ctx, ipv6, reqAddr.Port)
+	case DirectOutboundMode6:
+		if len(ipv6) == 0 {
+			return nil, noAddressError{IPv6: true}
+		}
+		return d.dialTCPAddrs(ctx, ipv6, reqAddr.Port)
+	case DirectOutboundMode4:
+		if len(ipv4) == 0 {
+			return nil, noAddressError{IPv4: true}
+		}
+		return d.dialTCPAddrs(ctx, ipv4, reqAddr.Port)
+	default:
+		return nil, invalidOutboundModeError{}
+	}
+}
+
+// dialHostTCP dials the host name of reqAddr, resolved by the dialer.
+func (d *directOutbound) dialHostTCP(ctx context.Context, reqAddr *acl.AddrEx) (net.Conn, error) {
 	hostPort := net.JoinHostPort(reqAddr.Host, strconv.Itoa(int(reqAddr.Port)))
 	switch d.Mode {
 	case DirectOutboundModeAuto:
@@ -223,6 +313,23 @@ func (d *directOutbound) dialTCP(ctx context.Context, ip net.IP, port uint16) (n
 	}
 }
 
+// dialTCPAddrs dials the addresses one after another until one connects.
+// It returns the last error if none does.
+func (d *directOutbound) dialTCPAddrs(ctx context.Context, ips []net.IP, port uint16) (net.Conn, error) {
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := d.dialTCP(ctx, ip, port)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
 func (d *directOutbound) GetName() string {
 	return d.Name
 }
@@ -233,16 +340,17 @@ type dialResult struct {
 }
 
 // dualStackDialTCP dials the target using both IPv4 and IPv6 addresses simultaneously.
-// It returns the first successful connection and drops the other one.
+// Each family tries its addresses in turn. It returns the first successful
+// connection and drops the other one.
 // If both connections fail, it returns the last error.
-func (d *directOutbound) dualStackDialTCP(ctx context.Context, ipv4, ipv6 net.IP, port uint16) (net.Conn, error) {
+func (d *directOutbound) dualStackDialTCP(ctx context.Context, ipv4, ipv6 []net.IP, port uint16) (net.Conn, error) {
 	ch := make(chan dialResult, 2)
 	go func() {
-		conn, err := d.dialTCP(ctx, ipv4, port)
+		conn, err := d.dialTCPAddrs(ctx, ipv4, port)
 		ch <- dialResult{Conn: conn, Err: err}
 	}()
 	go func() {
-		conn, err := d.dialTCP(ctx, ipv6, port)
+		conn, err := d.dialTCPAddrs(ctx, ipv6, port)
 		ch <- dialResult{Conn: conn, Err: err}
 	}()
 	// Get the first result, check if it's successful
@@ -281,12 +389,13 @@ func (u *directOutboundUDPConn) ReadFrom(b []byte) (int, *acl.AddrEx, error) {
 }
 
 func (u *directOutboundUDPConn) WriteTo(b []byte, addr *acl.AddrEx) (int, error) {
-	if addr.HostInfo.IPv4 == nil {
-		u.directOutbound.resolve(addr)
-	}
+	u.directOutbound.resolve(context.Background(), addr)
 	if addr.HostInfo.IPv4 == nil && addr.HostInfo.IPv6 == nil {
 		return 0, resolveError{Err: addr.Err}
 	}
+	if err := u.directOutbound.checkFakeIP(addr); err != nil {
+		return 0, err
+	}
 	if u.State == udpConnStateIPv4 {
 		if addr.HostInfo.IPv4 != nil {
 			return u.UDPConn.WriteToUDP(b, &net.UDPAddr{
@@ -397,9 +506,7 @@ func (d *directOutbound) UDP(reqAddr *acl.AddrEx) (acl.UDPConn, error) {
 		// Bind address specified,
 		// need to check what kind of address is in reqAddr
 		// to determine which address family to bind to
-		if reqAddr.HostInfo.IPv4 == nil {
-			d.resolve(reqAddr)
-		}
+		d.resolve(context.Background(), reqAddr)
 		if reqAddr.HostInfo.IPv4 == nil && reqAddr.HostInfo.IPv6 == nil {
 			return nil, resolveError{Err: reqAddr.Err}
 		}
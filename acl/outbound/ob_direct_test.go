@@ -0,0 +1,159 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/belowLevel/route_rule/acl"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectOutboundTCPFallback(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	var dials []string
+	var d net.Dialer
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials = append(dials, address)
+		host, _, _ := net.SplitHostPort(address)
+		if host != "127.0.0.1" {
+			return nil, errors.New("unreachable")
+		}
+		return d.DialContext(ctx, network, address)
+	}
+	ob := &directOutbound{Mode: DirectOutboundMode46, DialFunc4: dial, DialFunc6: dial}
+
+	reqAddr := &acl.AddrEx{Host: "cdn.example", Port: uint16(port), HostInfo: &acl.HostInfo{}}
+	reqAddr.HostInfo.SetIPs([]acl.ResolvedIP{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("127.0.0.1")},
+		{IP: net.ParseIP("2001:db8::1")},
+	})
+	conn, err := ob.TCP(context.Background(), reqAddr)
+	if assert.NoError(t, err) {
+		_ = conn.Close()
+	}
+	assert.Len(t, dials, 2)
+	assert.Equal(t, "127.0.0.1", reqAddr.ConnIp)
+
+	// Only the addresses of the family of the mode are tried.
+	dials = nil
+	ob.Mode = DirectOutboundMode6
+	_, err = ob.TCP(context.Background(), reqAddr)
+	assert.Error(t, err)
+	assert.Equal(t, []string{net.JoinHostPort("2001:db8::1", strconv.Itoa(port))}, dials)
+}
+
+func TestDirectOutboundTCPPrefilledHostInfo(t *testing.T) {
+	var dials []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials = append(dials, network+" "+address)
+		return nil, errors.New("unreachable")
+	}
+	ob := &directOutbound{Mode: DirectOutboundModeAuto, DialFunc4: dial, DialFunc6: dial}
+
+	// Addresses given along with the request are dialed instead of the host name.
+	reqAddr := &acl.AddrEx{Host: "example.com", Port: 443, HostInfo: &acl.HostInfo{IPv4: net.ParseIP("192.0.2.1")}}
+	_, err := ob.TCP(context.Background(), reqAddr)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"tcp4 192.0.2.1:443"}, dials)
+
+	// Without any, the dialer resolves the host name.
+	dials = nil
+	reqAddr = &acl.AddrEx{Host: "example.com", Port: 443, HostInfo: &acl.HostInfo{}}
+	_, err = ob.TCP(context.Background(), reqAddr)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"tcp example.com:443"}, dials)
+}
+
+// v6Resolver resolves every host to a single IPv6 address.
+type v6Resolver struct {
+	lookups int
+}
+
+func (r *v6Resolver) Resolve(ctx context.Context, host string) ([]acl.ResolvedIP, error) {
+	r.lookups++
+	return []acl.ResolvedIP{{IP: net.ParseIP("2001:db8::1")}}, nil
+}
+
+func TestDirectOutboundIPv6Only(t *testing.T) {
+	var dials []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials = append(dials, network+" "+address)
+		return nil, errors.New("unreachable")
+	}
+	r := &v6Resolver{}
+	ob := &directOutbound{Mode: DirectOutboundModeAuto, DialFunc4: dial, DialFunc6: dial, Resolver: r}
+
+	reqAddr := &acl.AddrEx{Host: "v6.example", Port: 443, HostInfo: &acl.HostInfo{}}
+	ob.resolve(context.Background(), reqAddr)
+	assert.NoError(t, reqAddr.Err)
+	assert.Nil(t, reqAddr.HostInfo.IPv4)
+	assert.Equal(t, "2001:db8::1", reqAddr.HostInfo.IPv6.String())
+
+	_, err := ob.TCP(context.Background(), reqAddr)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"tcp6 [2001:db8::1]:443"}, dials)
+	assert.Equal(t, 1, r.lookups)
+}
+
+// fakeRangeMapper treats a prefix as fake IPs without domains.
+type fakeRangeMapper struct {
+	prefix netip.Prefix
+}
+
+func (m fakeRangeMapper) Contains(addr netip.Addr) bool {
+	return m.prefix.Contains(addr)
+}
+
+func (m fakeRangeMapper) LookupHost(addr netip.Addr) (string, bool) {
+	return "", false
+}
+
+// fakeResolver resolves every host to a fake IP, like a system resolver
+// pointing at the fake-IP DNS server.
+type fakeResolver struct{}
+
+func (fakeResolver) Resolve(ctx context.Context, host string) ([]acl.ResolvedIP, error) {
+	return []acl.ResolvedIP{{IP: net.ParseIP("198.18.0.5")}}, nil
+}
+
+func TestDirectOutboundFakeIP(t *testing.T) {
+	var dials []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials = append(dials, network+" "+address)
+		return nil, errors.New("unreachable")
+	}
+	ob := &directOutbound{Mode: DirectOutboundModeAuto, DialFunc4: dial, DialFunc6: dial, Resolver: fakeResolver{}}
+	var guard acl.FakeIPGuard = ob
+	guard.SetFakeIP(fakeRangeMapper{netip.MustParsePrefix("198.18.0.0/15")})
+
+	_, err := ob.TCP(context.Background(), &acl.AddrEx{Host: "example.com", Port: 443})
+	assert.ErrorContains(t, err, "fake IP 198.18.0.5")
+	// Given along with the request.
+	_, err = ob.TCP(context.Background(), &acl.AddrEx{Host: "example.com", Port: 443, HostInfo: &acl.HostInfo{IPv4: net.ParseIP("198.18.0.6")}})
+	assert.ErrorContains(t, err, "fake IP 198.18.0.6")
+	assert.Empty(t, dials)
+
+	conn, err := ob.UDP(&acl.AddrEx{Host: "example.com", Port: 53})
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.WriteTo([]byte("x"), &acl.AddrEx{Host: "example.com", Port: 53})
+	assert.ErrorContains(t, err, "fake IP 198.18.0.5")
+}
@@ -26,6 +26,19 @@ func splitIPv4IPv6(ips []net.IP) (ipv4, ipv6 net.IP) {
 	return ipv4, ipv6
 }
 
+// splitIPFamilies splits a list of IP addresses into IPv4 and IPv6 ones,
+// keeping their order.
+func splitIPFamilies(ips []net.IP) (ipv4, ipv6 []net.IP) {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+	return ipv4, ipv6
+}
+
 // tryParseIP tries to parse the host string in the AddrEx as an IP address.
 // If the host is indeed an IP address, it will fill the ResolveInfo with the
 // parsed IP address and return true. Otherwise, it will return false.
@@ -6,7 +6,7 @@ import (
 	"strings"
 )
 
-var linePattern = regexp.MustCompile(`^(\w+)\s*\(([^,]+)(?:,([^,]+))?(?:,([^,]+))?\)$`)
+var linePattern = regexp.MustCompile(`^(\w+(?::\w+)?)\s*\(([^,]+)(?:,([^,]+))?(?:,([^,]+))?\)$`)
 
 type InvalidSyntaxError struct {
 	Line    string
@@ -24,6 +24,8 @@ func (e *InvalidSyntaxError) Error() string {
 //	outbound(address,protoPort)
 //	outbound(address,protoPort,hijackAddress)
 //
+// outbound may have a prefix, as in dns:resolver(address) for DNS rules.
+//
 // It does not check whether any of the fields is valid - it's up to the compiler to do so.
 type TextRule struct {
 	Outbound      string
@@ -40,9 +42,10 @@ func parseLine(line string, num int) *TextRule {
 		return nil
 	}
 	txt := line
-	strs := strings.Split(line, ":")
+	// Leave the prefix of the outbound alone.
+	strs := strings.Split(line[len(matches[1]):], ":")
 	if len(strs) >= 2 {
-		txt = strs[0] + ":" + strs[1]
+		txt = matches[1] + strs[0] + ":" + strs[1]
 		if len(strs[1]) > 0 && strs[1][len(strs[1])-1] != byte(')') {
 			txt += ")"
 		}
@@ -2,62 +2,176 @@ package acl
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/belowLevel/route_rule/acl/v2geo"
 	"net"
+	"net/netip"
 	"os"
-	"path"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const (
+	recordJournalSuffix = ".journal"
+	recordFlushBatch    = 256
+	// recordTouchInterval limits how often a hit refreshes the last-seen time
+	// of an entry, so that popular domains don't flood the journal.
+	recordTouchInterval = time.Hour
+	// recordMaxEntries caps the entries when RecordOptions.MaxSize is 0.
+	recordMaxEntries = 1 << 30
 )
 
+// RecordOptions controls how record: rules keep their learned domains.
+type RecordOptions struct {
+	// TTL drops entries that haven't been seen for this long. 0 = never expire.
+	TTL time.Duration
+	// MaxSize is the maximum number of entries, the least recently seen ones
+	// are evicted beyond that. 0 = no limit other than 1<<30 entries.
+	MaxSize int
+	// FlushInterval is how long newly learned domains are batched in memory
+	// before they are appended to the journal.
+	FlushInterval time.Duration
+	// CompactInterval is how often the journal is folded into the record file.
+	CompactInterval time.Duration
+}
+
+// DefaultRecordOptions returns the options used when none are given.
+func DefaultRecordOptions() RecordOptions {
+	return RecordOptions{
+		TTL:             30 * 24 * time.Hour,
+		MaxSize:         100000,
+		FlushInterval:   5 * time.Second,
+		CompactInterval: time.Hour,
+	}
+}
+
+// Record is a domain list that learns domains on its own: a domain that isn't
+// in the list yet is looked up by its IP country, and added to the list when
+// the conditions match.
+//
+// The record file holds one "domain last-seen" pair per line (a line with a
+// domain only is also accepted). Newly learned domains and refreshed
+// last-seen times are batched and appended to a journal next to it, which is
+// folded back into the record file periodically.
 type Record struct {
 	file       string
-	set        *v2geo.Set
+	set        *v2geo.MutableSet
 	conditions []string
 	operator   string
-	lock       sync.Mutex
+	lock       sync.Mutex // protects the fields below, and the files
 	ipReader   *IPReader
+	resolver   Resolver
+	mode       AddrMatchMode
+	opts       RecordOptions
+
+	seen        *lru.Cache[string, int64] // normalized entry -> last seen, unix seconds
+	pending     []string                  // journal lines not flushed yet
+	flushTimer  *time.Timer
+	lastCompact time.Time
+	closed      bool
+	compacting  sync.WaitGroup // background compactions of set
+}
+
+func (d *Record) journalFile() string {
+	return d.file + recordJournalSuffix
 }
 
 func (d *Record) Init() error {
-	var strs []string
 	if _, err := os.Stat(d.file); err != nil {
 		return err
 	}
+	entries := make(map[string]int64)
+	if err := readRecordFile(d.file, entries); err != nil {
+		return err
+	}
+	if err := readRecordFile(d.journalFile(), entries); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	size := d.opts.MaxSize
+	if size <= 0 {
+		size = recordMaxEntries
+	}
+	seen, err := lru.NewWithEvict[string, int64](size, func(domain string, _ int64) {
+		d.set.Delete(domain)
+	})
+	if err != nil {
+		return err
+	}
+	// Add the oldest first, so that the LRU order follows the last-seen times.
+	domains := make([]string, 0, len(entries))
+	for domain, ts := range entries {
+		if !d.expired(ts, time.Now()) {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return entries[domains[i]] < entries[domains[j]]
+	})
+	if len(domains) > d.opts.MaxSize && d.opts.MaxSize > 0 {
+		domains = domains[len(domains)-d.opts.MaxSize:]
+	}
+	d.set = v2geo.NewMutableSet(v2geo.NewSet(domains))
+	for _, domain := range domains {
+		seen.Add(domain, entries[domain])
+	}
+	d.seen = seen
+	d.lastCompact = time.Now()
+	return nil
+}
 
-	f, err := os.OpenFile(d.file, os.O_RDONLY, os.ModePerm)
+// readRecordFile reads "domain [last-seen]" lines into entries. Entries
+// without a time are treated as seen when the file was last written, so
+// that they still expire.
+func readRecordFile(file string, entries map[string]int64) error {
+	f, err := os.Open(file)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	modTime := info.ModTime().Unix()
 	scanner := bufio.NewScanner(f)
-	var count = 0
 	for scanner.Scan() {
 		line := scanner.Text()
 		line = strings.TrimSpace(line)
 		line = strings.TrimFunc(line, func(r rune) bool {
 			return !unicode.IsGraphic(r)
 		})
-		if line == "" {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
 			continue
 		}
-		count++
-		strs = append(strs, line)
-	}
-	if err := scanner.Err(); err != nil {
-		return err
-	}
-	if len(strs) == 0 {
-		strs = append(strs, "placeholder.placeholder")
+		ts := modTime
+		if len(fields) > 1 {
+			if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				ts = v
+			}
+		}
+		entries[v2geo.NormalizeEntry(fields[0])] = ts
 	}
-	d.set = v2geo.NewSet(strs)
-	return nil
+	return scanner.Err()
+}
+
+func (d *Record) expired(ts int64, now time.Time) bool {
+	return d.opts.TTL > 0 && now.Sub(time.Unix(ts, 0)) > d.opts.TTL
 }
 
 func (d *Record) Match(reqAddr *AddrEx) bool {
+	return d.MatchContext(context.Background(), reqAddr)
+}
+
+func (d *Record) MatchContext(ctx context.Context, reqAddr *AddrEx) bool {
 	if reqAddr.Err != nil {
 		return false
 	}
@@ -72,31 +186,34 @@ func (d *Record) Match(reqAddr *AddrEx) bool {
 	if ip != nil {
 		return false
 	}
-	if d.set.Has(host) {
+	if hit, ok := d.set.Match(host); ok && d.touch(hit, host) {
+		reqAddr.Hit = hit
 		return true
 	}
 
-	if reqAddr.HostInfo.IPv4 == nil {
-		localResolve(reqAddr)
-	}
-	if reqAddr.HostInfo.IPv4 != nil {
-		return d.matchISO(reqAddr.HostInfo.IPv4, host)
+	if reqAddr.Resolve(ctx, d.resolver) != nil {
+		return false
 	}
-	if reqAddr.HostInfo.IPv6 != nil {
-		return d.matchISO(reqAddr.HostInfo.IPv6, host)
+	if d.mode.match(reqAddr.HostInfo.Addrs(), d.matchISO) {
+		d.learn(host)
+		return true
 	}
 	return false
 }
 
-func (d *Record) matchISO(ipAddress net.IP, host string) bool {
+// matchISO reports whether the country of ipAddress meets the conditions.
+func (d *Record) matchISO(ipAddress net.IP) bool {
 	if d.ipReader == nil {
 		return false
 	}
-	isos := d.ipReader.LookupCode(ipAddress)
-	if len(isos) == 0 {
+	addr, ok := netip.AddrFromSlice(ipAddress)
+	if !ok {
+		return false
+	}
+	iso, ok := d.ipReader.LookupCountry(addr)
+	if !ok {
 		return false
 	}
-	iso := isos[0]
 	var match bool
 	if d.operator == "and" {
 		match = true
@@ -130,13 +247,7 @@ func (d *Record) matchISO(ipAddress net.IP, host string) bool {
 		return false
 	}
 
-	if match {
-		go func() {
-			d.save(host)
-		}()
-		return true
-	}
-	return false
+	return match
 }
 
 func (d *Record) Size() int {
@@ -146,53 +257,180 @@ func (d *Record) Size() int {
 	return d.set.Size()
 }
 
-func (d *Record) save(domain string) {
+// seenEntry maps a hit of d.set.Match for host back to its entry in d.seen.
+// Hits are bare domains, while exact entries are kept with PrefixFull.
+func (d *Record) seenEntry(hit, host string) (string, int64, bool) {
+	if ts, ok := d.seen.Peek(hit); ok {
+		return hit, ts, true
+	}
+	if hit == host {
+		entry := v2geo.PrefixFull + hit
+		if ts, ok := d.seen.Peek(entry); ok {
+			return entry, ts, true
+		}
+	}
+	return "", 0, false
+}
+
+// touch refreshes the last-seen time of the entry hit by host.
+// Returns false if the entry turned out to be expired, and drops it.
+// Most hits only read the LRU, which has its own lock; d.lock is taken
+// when the entry needs a change.
+func (d *Record) touch(hit, host string) bool {
+	now := time.Now()
+	domain, ts, ok := d.seenEntry(hit, host)
+	if !ok {
+		// Evicted in the meantime.
+		return false
+	}
+	if !d.expired(ts, now) && now.Sub(time.Unix(ts, 0)) <= recordTouchInterval {
+		return true
+	}
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	var strs = make([]string, 0, 1000)
-	var seen = make(map[string]bool, 1000)
-	if _, err := os.Stat(d.file); err == nil {
-		f, err := os.OpenFile(d.file, os.O_RDONLY, os.ModePerm)
-		if err != nil {
-			return
-		}
-		defer f.Close()
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			line := scanner.Text()
-			line = strings.TrimSpace(line)
-			line = strings.TrimFunc(line, func(r rune) bool {
-				return !unicode.IsGraphic(r)
-			})
-			if line == "" {
-				continue
-			}
-			if seen[line] {
-				continue
-			}
-			strs = append(strs, line)
-		}
-		if err := scanner.Err(); err != nil {
-			return
-		}
+	domain, ts, ok = d.seenEntry(hit, host)
+	if !ok {
+		return false
+	}
+	if d.expired(ts, now) {
+		d.seen.Remove(domain)
+		return false
+	}
+	if now.Sub(time.Unix(ts, 0)) > recordTouchInterval {
+		d.seen.Add(domain, now.Unix())
+		d.enqueue(domain, now)
+	}
+	return true
+}
 
+// learn adds a domain. It is visible to Match right away, and written to
+// the journal with the next batch.
+func (d *Record) learn(domain string) {
+	now := time.Now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.seen.Add(domain, now.Unix())
+	if d.set.Insert(domain) {
+		d.enqueue(domain, now)
 	}
-	if seen[domain] {
+}
+
+// enqueue queues a journal line and makes sure a flush is scheduled.
+// Must hold d.lock.
+func (d *Record) enqueue(domain string, now time.Time) {
+	d.pending = append(d.pending, domain+" "+strconv.FormatInt(now.Unix(), 10)+"\n")
+	if d.closed {
+		// Nothing flushes anymore, they go with the next Flush if any.
 		return
 	}
-	strs = append(strs, domain)
-	f, err := os.OpenFile(d.file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.ModePerm)
-	if err != nil {
+	if len(d.pending) >= recordFlushBatch {
+		if d.flushTimer != nil {
+			d.flushTimer.Stop()
+			d.flushTimer = nil
+		}
+		go d.Flush()
 		return
 	}
+	if d.flushTimer == nil {
+		d.flushTimer = time.AfterFunc(d.opts.FlushInterval, func() {
+			_ = d.Flush()
+		})
+	}
+}
+
+// Flush appends the pending entries to the journal, and compacts the journal
+// into the record file when CompactInterval has passed.
+func (d *Record) Flush() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.flushTimer != nil {
+		d.flushTimer.Stop()
+		d.flushTimer = nil
+	}
+	if d.opts.CompactInterval > 0 && time.Since(d.lastCompact) >= d.opts.CompactInterval {
+		return d.compact()
+	}
+	return d.flushJournal()
+}
+
+// Close stops the background flushing, writes the pending entries to
+// the journal and waits for the background compactions of the set.
+// The Record can still be matched, but learned domains are only written by
+// an explicit Flush.
+func (d *Record) Close() error {
+	d.lock.Lock()
+	d.closed = true
+	if d.flushTimer != nil {
+		d.flushTimer.Stop()
+		d.flushTimer = nil
+	}
+	err := d.flushJournal()
+	d.lock.Unlock()
+	d.compacting.Wait()
+	return err
+}
+
+// flushJournal must hold d.lock.
+func (d *Record) flushJournal() error {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(d.journalFile(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
-	for _, v := range strs {
-		f.WriteString(v + "\n")
+	if _, err := f.WriteString(strings.Join(d.pending, "")); err != nil {
+		return err
 	}
-	d.Init()
+	d.pending = d.pending[:0]
+	return nil
+}
+
+// Compact drops expired entries, rewrites the record file from memory and
+// removes the journal.
+func (d *Record) Compact() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.compact()
+}
+
+// compact must hold d.lock.
+func (d *Record) compact() error {
+	now := time.Now()
+	var sb strings.Builder
+	// Keys are ordered from the least recently seen.
+	for _, domain := range d.seen.Keys() {
+		ts, ok := d.seen.Peek(domain)
+		if !ok {
+			continue
+		}
+		if d.expired(ts, now) {
+			d.seen.Remove(domain)
+			continue
+		}
+		sb.WriteString(domain + " " + strconv.FormatInt(ts, 10) + "\n")
+	}
+	tmp := d.file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, d.file); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	d.pending = d.pending[:0]
+	if err := os.Remove(d.journalFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	d.lastCompact = now
+	d.compacting.Go(func() {
+		_ = d.set.Compact()
+	})
+	return nil
 }
 
-func newRecord(addr string, ipreader *IPReader) (*Record, error) {
+func newRecord(addr string, ipreader *IPReader, opts *CompileOptions) (*Record, error) {
 	suffix := addr[7:]
 	idx := strings.Index(suffix, ":")
 	if idx == -1 {
@@ -204,7 +442,7 @@ func newRecord(addr string, ipreader *IPReader) (*Record, error) {
 	if idx == -1 {
 		return nil, fmt.Errorf("%s format invalid", file)
 	}
-	operator := suffix[:idx]
+	operator := strings.ToLower(suffix[:idx])
 	suffix = suffix[idx+1:]
 	if operator != "and" && operator != "or" {
 		return nil, fmt.Errorf("%s format invalid", file)
@@ -214,16 +452,18 @@ func newRecord(addr string, ipreader *IPReader) (*Record, error) {
 		return nil, fmt.Errorf("%s format invalid", file)
 	}
 
-	ex, err := os.Executable()
+	file, err := opts.dataPath(file)
 	if err != nil {
 		return nil, err
 	}
-	workDir := filepath.Dir(ex)
 	fi := &Record{
-		file:       path.Join(workDir, file),
+		file:       file,
 		operator:   operator,
 		conditions: conditions,
 		ipReader:   ipreader,
+		resolver:   opts.Resolver,
+		mode:       opts.AddrMatch,
+		opts:       opts.recordOptions(),
 	}
 	err = fi.Init()
 	if err != nil {
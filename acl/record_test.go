@@ -1 +1,172 @@
 package acl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRecord(t *testing.T, content string, opts RecordOptions) *Record {
+	file := filepath.Join(t.TempDir(), "record.txt")
+	assert.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+	d := &Record{file: file, opts: opts}
+	assert.NoError(t, d.Init())
+	return d
+}
+
+func TestRecordLearn(t *testing.T) {
+	d := newTestRecord(t, "google.com\n", RecordOptions{FlushInterval: time.Hour})
+
+	reqAddr := &AddrEx{Host: "www.google.com", HostInfo: &HostInfo{}}
+	assert.True(t, d.Match(reqAddr))
+	assert.Equal(t, "google.com", reqAddr.Hit)
+
+	d.learn("apple.com")
+	d.learn("apple.com")
+	assert.True(t, d.Match(&AddrEx{Host: "www.apple.com", HostInfo: &HostInfo{}}))
+
+	// Nothing is written before the batch is flushed.
+	_, err := os.Stat(d.journalFile())
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, d.Flush())
+	bs, err := os.ReadFile(d.journalFile())
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	assert.Len(t, lines, 1)
+	assert.True(t, strings.HasPrefix(lines[0], "apple.com "))
+
+	// A new Record picks up both the file and the journal.
+	d2 := &Record{file: d.file}
+	assert.NoError(t, d2.Init())
+	assert.True(t, d2.Match(&AddrEx{Host: "www.apple.com", HostInfo: &HostInfo{}}))
+
+	assert.NoError(t, d.Compact())
+	_, err = os.Stat(d.journalFile())
+	assert.True(t, os.IsNotExist(err))
+	bs, err = os.ReadFile(d.file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(bs), "google.com ")
+	assert.Contains(t, string(bs), "apple.com ")
+}
+
+func TestRecordTTL(t *testing.T) {
+	old := time.Now().Add(-48 * time.Hour).Unix()
+	content := fmt.Sprintf("old.com %d\nfresh.com\n", old)
+	d := newTestRecord(t, content, RecordOptions{TTL: 24 * time.Hour, FlushInterval: time.Hour})
+	assert.False(t, d.set.Has("old.com"))
+	assert.True(t, d.set.Has("fresh.com"))
+
+	// Entries that expire while loaded are dropped on the next hit.
+	d.seen.Add("fresh.com", old)
+	assert.False(t, d.touch("fresh.com", "fresh.com"))
+	assert.False(t, d.set.Has("fresh.com"))
+}
+
+func TestRecordMaxSize(t *testing.T) {
+	now := time.Now().Unix()
+	var sb strings.Builder
+	for i := 0; i < 5; i++ {
+		sb.WriteString(fmt.Sprintf("d%d.com %s\n", i, strconv.FormatInt(now-int64(10-i), 10)))
+	}
+	d := newTestRecord(t, sb.String(), RecordOptions{MaxSize: 3, FlushInterval: time.Hour})
+	assert.False(t, d.set.Has("d0.com"))
+	assert.False(t, d.set.Has("d1.com"))
+	assert.True(t, d.set.Has("d2.com"))
+
+	// d2 is the least recently seen, so it goes first.
+	d.learn("new.com")
+	assert.True(t, d.set.Has("new.com"))
+	assert.False(t, d.set.Has("d2.com"))
+	assert.True(t, d.set.Has("d3.com"))
+}
+
+func TestRecordConcurrentHits(t *testing.T) {
+	d := newTestRecord(t, "google.com\n", RecordOptions{FlushInterval: time.Hour})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				assert.True(t, d.touch("google.com", "google.com"))
+			}
+		}()
+	}
+	d.learn("apple.com")
+	wg.Wait()
+	assert.True(t, d.set.Has("apple.com"))
+}
+
+func TestRecordClose(t *testing.T) {
+	d := newTestRecord(t, "google.com\n", RecordOptions{FlushInterval: time.Hour})
+	d.learn("apple.com")
+	assert.NotNil(t, d.flushTimer)
+	assert.NoError(t, d.Close())
+	assert.Nil(t, d.flushTimer)
+	bs, err := os.ReadFile(d.journalFile())
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(bs), "apple.com "))
+
+	// No more timers once closed.
+	d.learn("example.com")
+	assert.Nil(t, d.flushTimer)
+	assert.True(t, d.set.Has("example.com"))
+
+	// Close waits for the set to be compacted.
+	assert.NoError(t, d.Compact())
+	assert.NoError(t, d.Close())
+	assert.Zero(t, d.set.Pending())
+}
+
+func TestRecordUntimedEntries(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "record.txt")
+	assert.NoError(t, os.WriteFile(file, []byte("google.com\n"), 0o644))
+	old := time.Now().Add(-48 * time.Hour)
+	assert.NoError(t, os.Chtimes(file, old, old))
+
+	// Seen when the file was written, not whenever it is loaded.
+	d := &Record{file: file, opts: RecordOptions{TTL: 24 * time.Hour, FlushInterval: time.Hour}}
+	assert.NoError(t, d.Init())
+	assert.False(t, d.set.Has("google.com"))
+
+	d = &Record{file: file, opts: RecordOptions{TTL: 72 * time.Hour, FlushInterval: time.Hour}}
+	assert.NoError(t, d.Init())
+	ts, ok := d.seen.Peek("google.com")
+	assert.True(t, ok)
+	assert.Equal(t, old.Unix(), ts)
+}
+
+func TestRecordPrefixedEntries(t *testing.T) {
+	old := time.Now().Add(-2 * recordTouchInterval).Unix()
+	content := fmt.Sprintf("full:www.apple.com %d\ndomain:google.com %d\n", old, old)
+	d := newTestRecord(t, content, RecordOptions{TTL: 24 * time.Hour, FlushInterval: time.Hour})
+
+	reqAddr := &AddrEx{Host: "mail.google.com", HostInfo: &HostInfo{}}
+	assert.True(t, d.Match(reqAddr))
+	assert.Equal(t, "google.com", reqAddr.Hit)
+	reqAddr = &AddrEx{Host: "www.apple.com", HostInfo: &HostInfo{}}
+	assert.True(t, d.Match(reqAddr))
+	assert.Equal(t, "www.apple.com", reqAddr.Hit)
+
+	// Both hits refreshed their entries.
+	ts, ok := d.seen.Peek("google.com")
+	assert.True(t, ok)
+	assert.Greater(t, ts, old)
+	ts, ok = d.seen.Peek("full:www.apple.com")
+	assert.True(t, ok)
+	assert.Greater(t, ts, old)
+	assert.Len(t, d.pending, 2)
+
+	// And expire with them.
+	d.seen.Add("full:www.apple.com", time.Now().Add(-48*time.Hour).Unix())
+	assert.False(t, d.touch("www.apple.com", "www.apple.com"))
+	assert.False(t, d.set.Has("www.apple.com"))
+	assert.True(t, d.set.Has("google.com"))
+}
@@ -0,0 +1,351 @@
+package acl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const (
+	defaultResolverCacheSize = 1024
+	defaultResolverTTL       = time.Minute
+	defaultNegativeTTL       = 10 * time.Second
+	defaultHostsTTL          = time.Hour
+)
+
+// ResolvedIP is an address of a host, along with how long it may be cached.
+// A TTL of 0 means the resolver doesn't know.
+type ResolvedIP struct {
+	IP  net.IP
+	TTL time.Duration
+}
+
+// Resolver resolves host names for rules that match on addresses, and for
+// outbounds that need to connect to a host.
+type Resolver interface {
+	// Resolve returns the IPv4 and IPv6 addresses of host. An error is
+	// returned if there are none.
+	Resolve(ctx context.Context, host string) ([]ResolvedIP, error)
+}
+
+var (
+	_ Resolver = (*SystemResolver)(nil)
+	_ Resolver = (*CachingResolver)(nil)
+	_ Resolver = (*HostsResolver)(nil)
+)
+
+// LookupIP is like net.LookupIP, using r. A nil r is the system resolver.
+func LookupIP(ctx context.Context, r Resolver, host string) ([]net.IP, error) {
+	if r == nil {
+		r = &SystemResolver{}
+	}
+	resolved, err := r.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(resolved))
+	for i, ip := range resolved {
+		ips[i] = ip.IP
+	}
+	return ips, nil
+}
+
+// ResolveSource is where the addresses of a HostInfo came from.
+type ResolveSource int
+
+const (
+	ResolveSourceNone     ResolveSource = iota // Not resolved
+	ResolveSourceCaller                        // Given along with the request
+	ResolveSourceLiteral                       // The host is an IP address
+	ResolveSourceResolver                      // Looked up by a Resolver
+)
+
+func (s ResolveSource) String() string {
+	switch s {
+	case ResolveSourceNone:
+		return "none"
+	case ResolveSourceCaller:
+		return "caller"
+	case ResolveSourceLiteral:
+		return "literal"
+	case ResolveSourceResolver:
+		return "resolver"
+	default:
+		return "ResolveSource(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// Resolve fills in the addresses of the host using r, or the system
+// resolver if r is nil. A request is resolved at most once, by whichever
+// matcher or outbound needs its addresses first; later calls return the
+// same error. Addresses the request came with, or a host that is an IP
+// address, count as resolved. A failure is also set as a.Err.
+func (a *AddrEx) Resolve(ctx context.Context, r Resolver) error {
+	if a.HostInfo == nil {
+		a.HostInfo = &HostInfo{}
+	}
+	h := a.HostInfo
+	if h.Resolved() {
+		return h.ResolveErr
+	}
+	switch {
+	case len(h.Addrs()) > 0:
+		h.Source = ResolveSourceCaller
+	case net.ParseIP(a.Host) != nil:
+		h.SetIPs([]ResolvedIP{{IP: net.ParseIP(a.Host)}})
+		h.Source = ResolveSourceLiteral
+	default:
+		if r == nil {
+			r = &SystemResolver{}
+		}
+		ips, err := r.Resolve(ctx, a.Host)
+		h.Source = ResolveSourceResolver
+		if err != nil {
+			h.ResolveErr = err
+			a.Err = err
+		} else {
+			h.SetIPs(ips)
+		}
+	}
+	h.ResolvedAt = time.Now()
+	return h.ResolveErr
+}
+
+// SystemResolver resolves through Go's built-in resolver, which doesn't
+// report TTLs.
+type SystemResolver struct {
+	// Resolver defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+	// TTL is reported for all addresses. Defaults to 0, unknown.
+	TTL time.Duration
+}
+
+func (r *SystemResolver) Resolve(ctx context.Context, host string) ([]ResolvedIP, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]ResolvedIP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = ResolvedIP{IP: addr.IP, TTL: r.TTL}
+	}
+	return ips, nil
+}
+
+// CachingResolverOptions controls how long CachingResolver keeps results.
+// Zero values use the defaults.
+type CachingResolverOptions struct {
+	// Size is the maximum number of cached hosts. Defaults to 1024.
+	Size int
+	// DefaultTTL is used when the addresses come without a TTL.
+	// Defaults to 1 minute.
+	DefaultTTL time.Duration
+	// MinTTL and MaxTTL clamp the TTLs reported by the upstream resolver.
+	// 0 = no clamping.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is how long failed lookups are cached. Defaults to 10
+	// seconds, a negative value disables it.
+	NegativeTTL time.Duration
+}
+
+// CachingResolver caches the results of another Resolver for as long as
+// their TTLs allow. Concurrent lookups of the same host share one upstream
+// lookup.
+type CachingResolver struct {
+	resolver Resolver
+	opts     CachingResolverOptions
+	cache    *lru.Cache[string, *resolverCacheEntry]
+	flight   geoFlight[*resolverCacheEntry]
+	now      func() time.Time
+}
+
+type resolverCacheEntry struct {
+	ips     []ResolvedIP
+	err     error
+	expires time.Time
+}
+
+func NewCachingResolver(resolver Resolver, opts CachingResolverOptions) (*CachingResolver, error) {
+	if resolver == nil {
+		return nil, errors.New("nil resolver")
+	}
+	if opts.Size <= 0 {
+		opts.Size = defaultResolverCacheSize
+	}
+	if opts.DefaultTTL <= 0 {
+		opts.DefaultTTL = defaultResolverTTL
+	}
+	if opts.NegativeTTL == 0 {
+		opts.NegativeTTL = defaultNegativeTTL
+	}
+	cache, err := lru.New[string, *resolverCacheEntry](opts.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &CachingResolver{
+		resolver: resolver,
+		opts:     opts,
+		cache:    cache,
+		now:      time.Now,
+	}, nil
+}
+
+// Resolve returns the cached addresses of host if they haven't expired yet,
+// with their TTLs reduced by the time they spent in the cache.
+func (r *CachingResolver) Resolve(ctx context.Context, host string) ([]ResolvedIP, error) {
+	host = normalizeHost(host)
+	if e, ok := r.cache.Get(host); ok {
+		if ips, ok, err := r.fromEntry(e); ok {
+			return ips, err
+		}
+		r.cache.Remove(host)
+	}
+	e, err := r.flight.do(ctx, host, func(ctx context.Context) (*resolverCacheEntry, error) {
+		e := r.lookup(ctx, host)
+		if !e.expires.IsZero() {
+			r.cache.Add(host, e)
+		}
+		return e, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	ips, _, err := r.fromEntry(e)
+	return ips, err
+}
+
+func (r *CachingResolver) lookup(ctx context.Context, host string) *resolverCacheEntry {
+	now := r.now()
+	ips, err := r.resolver.Resolve(ctx, host)
+	if err != nil {
+		e := &resolverCacheEntry{err: err}
+		// Don't remember that we gave up.
+		if r.opts.NegativeTTL > 0 && ctx.Err() == nil {
+			e.expires = now.Add(r.opts.NegativeTTL)
+		}
+		return e
+	}
+	// The entry expires with the address that expires first.
+	var ttl time.Duration
+	for i, ip := range ips {
+		t := r.clampTTL(ip.TTL)
+		if i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	return &resolverCacheEntry{ips: ips, expires: now.Add(ttl)}
+}
+
+func (r *CachingResolver) clampTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = r.opts.DefaultTTL
+	}
+	if r.opts.MinTTL > 0 && ttl < r.opts.MinTTL {
+		ttl = r.opts.MinTTL
+	}
+	if r.opts.MaxTTL > 0 && ttl > r.opts.MaxTTL {
+		ttl = r.opts.MaxTTL
+	}
+	return ttl
+}
+
+// fromEntry returns the result of e with the remaining TTL,
+// or false if it has expired.
+func (r *CachingResolver) fromEntry(e *resolverCacheEntry) ([]ResolvedIP, bool, error) {
+	if e.expires.IsZero() {
+		// Never cached, only shared with the concurrent lookups.
+		return e.ips, true, e.err
+	}
+	left := e.expires.Sub(r.now())
+	if left <= 0 {
+		return nil, false, nil
+	}
+	if e.err != nil {
+		return nil, true, e.err
+	}
+	ips := make([]ResolvedIP, len(e.ips))
+	for i, ip := range e.ips {
+		ips[i] = ResolvedIP{IP: ip.IP, TTL: left}
+	}
+	return ips, true, nil
+}
+
+// Purge drops all cached results.
+func (r *CachingResolver) Purge() {
+	r.cache.Purge()
+}
+
+// HostsResolver resolves a static list of hosts, e.g. from a hosts file.
+// Other hosts are passed on to the next Resolver, if any.
+type HostsResolver struct {
+	hosts map[string][]net.IP
+	next  Resolver
+	// TTL is reported for the static addresses. Defaults to 1 hour.
+	TTL time.Duration
+}
+
+func NewHostsResolver(hosts map[string][]net.IP, next Resolver) *HostsResolver {
+	m := make(map[string][]net.IP, len(hosts))
+	for host, ips := range hosts {
+		host = normalizeHost(host)
+		m[host] = append(m[host], ips...)
+	}
+	return &HostsResolver{hosts: m, next: next, TTL: defaultHostsTTL}
+}
+
+func (r *HostsResolver) Resolve(ctx context.Context, host string) ([]ResolvedIP, error) {
+	if ips, ok := r.hosts[normalizeHost(host)]; ok {
+		resolved := make([]ResolvedIP, len(ips))
+		for i, ip := range ips {
+			resolved[i] = ResolvedIP{IP: ip, TTL: r.TTL}
+		}
+		return resolved, nil
+	}
+	if r.next != nil {
+		return r.next.Resolve(ctx, host)
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// ParseHosts reads hosts in the format of /etc/hosts: an address followed by
+// its names on each line, # starts a comment. Invalid lines are skipped.
+func ParseHosts(r io.Reader) (map[string][]net.IP, error) {
+	hosts := make(map[string][]net.IP)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		// Zones such as fe80::1%lo0 can't be used in a net.IP.
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = normalizeHost(name)
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,102 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/belowLevel/route_rule/acl"
+)
+
+// OutboundDial returns a DialFunc that connects through ob: TCP through
+// ob.TCP, and UDP through ob.UDP, e.g. a SOCKS5 UDP associate. The host of
+// the address is passed on as is, so a proxy resolves upstreams named by
+// host on its side.
+//
+// Outbounds without UDP support, such as HTTP proxies, need TCP, TLS or
+// HTTPS upstreams.
+func OutboundDial(ob acl.Outbound) DialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, &net.AddrError{Err: "invalid port", Addr: address}
+		}
+		reqAddr := &acl.AddrEx{
+			Host:     host,
+			Port:     uint16(port),
+			HostInfo: &acl.HostInfo{},
+		}
+		if strings.HasPrefix(network, "udp") {
+			reqAddr.Proto = acl.ProtocolUDP
+			conn, err := ob.UDP(reqAddr)
+			if err != nil {
+				return nil, err
+			}
+			return &outboundPacketConn{
+				conn:  conn,
+				addr:  reqAddr,
+				raddr: outboundAddr{network, address},
+			}, nil
+		}
+		reqAddr.Proto = acl.ProtocolTCP
+		return ob.TCP(ctx, reqAddr)
+	}
+}
+
+// outboundPacketConn makes an acl.UDPConn look like a connected UDP socket,
+// which the DNS client reads and writes whole messages from. It has no
+// deadlines; exchanges time out by closing it.
+type outboundPacketConn struct {
+	conn  acl.UDPConn
+	addr  *acl.AddrEx
+	raddr net.Addr
+}
+
+func (c *outboundPacketConn) Read(b []byte) (int, error) {
+	n, _, err := c.conn.ReadFrom(b)
+	return n, err
+}
+
+func (c *outboundPacketConn) Write(b []byte) (int, error) {
+	return c.conn.WriteTo(b, c.addr)
+}
+
+func (c *outboundPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.raddr, err
+}
+
+func (c *outboundPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *outboundPacketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *outboundPacketConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{}
+}
+
+func (c *outboundPacketConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *outboundPacketConn) SetDeadline(time.Time) error      { return nil }
+func (c *outboundPacketConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *outboundPacketConn) SetWriteDeadline(time.Time) error { return nil }
+
+// outboundAddr is an address that may name a host rather than an IP.
+type outboundAddr struct {
+	network string
+	address string
+}
+
+func (a outboundAddr) Network() string { return a.network }
+func (a outboundAddr) String() string  { return a.address }
@@ -0,0 +1,132 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/belowLevel/route_rule/acl"
+	"github.com/belowLevel/route_rule/acl/outbound"
+	"github.com/stretchr/testify/assert"
+	"github.com/txthinking/socks5"
+)
+
+// hostsOutbound connects locally, mapping host names of its own, and
+// records what it was asked to connect to.
+type hostsOutbound struct {
+	hosts map[string]string
+
+	mu    sync.Mutex
+	dials []string
+}
+
+func (o *hostsOutbound) target(reqAddr *acl.AddrEx) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	proto := "tcp"
+	if reqAddr.Proto == acl.ProtocolUDP {
+		proto = "udp"
+	}
+	o.dials = append(o.dials, proto+" "+reqAddr.String())
+	host := reqAddr.Host
+	if ip, ok := o.hosts[host]; ok {
+		host = ip
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(reqAddr.Port)))
+}
+
+func (o *hostsOutbound) TCP(ctx context.Context, reqAddr *acl.AddrEx) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", o.target(reqAddr))
+}
+
+func (o *hostsOutbound) UDP(reqAddr *acl.AddrEx) (acl.UDPConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", o.target(reqAddr))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &connectedUDPConn{conn}, nil
+}
+
+func (o *hostsOutbound) GetName() string {
+	return "hosts"
+}
+
+type connectedUDPConn struct {
+	*net.UDPConn
+}
+
+func (c *connectedUDPConn) ReadFrom(b []byte) (int, *acl.AddrEx, error) {
+	n, err := c.UDPConn.Read(b)
+	return n, nil, err
+}
+
+func (c *connectedUDPConn) WriteTo(b []byte, _ *acl.AddrEx) (int, error) {
+	return c.UDPConn.Write(b)
+}
+
+func TestResolverThroughOutbound(t *testing.T) {
+	addr := startUDPTCP(t, &testZone{records: testZoneRecords()})
+	_, port, _ := net.SplitHostPort(addr)
+
+	for _, scheme := range []string{"udp", "tcp"} {
+		ob := &hostsOutbound{hosts: map[string]string{"dns.internal": "127.0.0.1"}}
+		r, err := New(Options{
+			// Only the outbound knows this host.
+			Upstreams:       []string{scheme + "://dns.internal:" + port},
+			UpstreamOptions: UpstreamOptions{Outbound: ob},
+		})
+		assert.NoError(t, err)
+		ips, err := r.Resolve(context.Background(), "example.test")
+		assert.NoError(t, err, scheme)
+		assert.Len(t, ips, 3, scheme)
+		assert.Contains(t, ob.dials, scheme+" dns.internal:"+port)
+	}
+}
+
+func TestResolverThroughSOCKS5(t *testing.T) {
+	addr := startUDPTCP(t, &testZone{records: testZoneRecords()})
+
+	// The SOCKS5 server needs TCP and UDP on the same port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	proxyAddr := l.Addr().String()
+	_ = l.Close()
+	srv, err := socks5.NewClassicServer(proxyAddr, "127.0.0.1", "", "", 1, 1)
+	assert.NoError(t, err)
+	go func() {
+		_ = srv.ListenAndServe(nil)
+	}()
+	defer srv.Shutdown()
+	// Wait for it to listen.
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err == nil {
+			_ = conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ob := outbound.NewSOCKS5Outbound(proxyAddr, "", "", "socks5")
+	for _, scheme := range []string{"udp", "tcp"} {
+		r, err := New(Options{
+			Upstreams:       []string{scheme + "://" + addr},
+			UpstreamOptions: UpstreamOptions{Outbound: ob, Timeout: 2 * time.Second},
+		})
+		assert.NoError(t, err)
+		ips, err := r.Resolve(context.Background(), "example.test")
+		assert.NoError(t, err, scheme)
+		assert.Len(t, ips, 3, scheme)
+	}
+}
@@ -0,0 +1,325 @@
+// Package resolver is a DNS client for acl.Resolver, with UDP, TCP, DNS over
+// TLS and DNS over HTTPS upstreams.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/belowLevel/route_rule/acl"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultCacheSize   = 1024
+	defaultNegativeTTL = 30 * time.Second
+	defaultRaceDelay   = 50 * time.Millisecond
+)
+
+var _ acl.Resolver = (*Resolver)(nil)
+
+// Options controls a Resolver. Zero values use the defaults.
+type Options struct {
+	// Upstreams are queried in parallel, the first usable answer wins.
+	// See ParseUpstream for the format.
+	Upstreams []string
+	UpstreamOptions
+
+	// CacheSize is the maximum number of cached answers. Defaults to 1024.
+	CacheSize int
+	// MinTTL and MaxTTL clamp the TTLs of answers. 0 = no clamping.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is how long answers without addresses are cached when they
+	// don't say so themselves (RFC 2308). Defaults to 30 seconds.
+	NegativeTTL time.Duration
+	// RaceDelay is how long to wait for the other of A and AAAA once one of
+	// them has addresses. Defaults to 50ms.
+	RaceDelay time.Duration
+}
+
+// queryResult is the result of a query, shared by concurrent lookups of it.
+type queryResult struct {
+	ips []net.IP
+	ttl time.Duration
+}
+
+// Resolver resolves hosts by querying A and AAAA records from its upstreams,
+// and caches the answers, including negative ones, for as long as their TTLs
+// allow.
+type Resolver struct {
+	upstreams []Upstream
+	opts      Options
+	cache     *lru.Cache[cacheKey, *cacheEntry]
+	now       func() time.Time
+	// flight shares a query between concurrent lookups of the same name.
+	flight singleflight.Group
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// New creates a Resolver for opts.Upstreams.
+func New(opts Options) (*Resolver, error) {
+	if len(opts.Upstreams) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+	upstreams := make([]Upstream, len(opts.Upstreams))
+	for i, s := range opts.Upstreams {
+		u, err := ParseUpstream(s, opts.UpstreamOptions)
+		if err != nil {
+			return nil, err
+		}
+		upstreams[i] = u
+	}
+	return NewWithUpstreams(upstreams, opts)
+}
+
+// NewWithUpstreams is like New, with upstreams that are already set up.
+// opts.Upstreams is ignored, and of opts.UpstreamOptions only Timeout is used,
+// to bound queries shared by several lookups.
+func NewWithUpstreams(upstreams []Upstream, opts Options) (*Resolver, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = defaultCacheSize
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = defaultNegativeTTL
+	}
+	if opts.RaceDelay <= 0 {
+		opts.RaceDelay = defaultRaceDelay
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultUpstreamTimeout
+	}
+	cache, err := lru.New[cacheKey, *cacheEntry](opts.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{
+		upstreams: upstreams,
+		opts:      opts,
+		cache:     cache,
+		now:       time.Now,
+	}, nil
+}
+
+// Resolve returns the IPv4 addresses of host followed by the IPv6 ones, each
+// with the TTL left of its answer. A and AAAA are queried at the same time;
+// once one of them has addresses, the other gets RaceDelay to catch up before
+// it is given up on.
+func (r *Resolver) Resolve(ctx context.Context, host string) ([]acl.ResolvedIP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []acl.ResolvedIP{{IP: ip}}, nil
+	}
+	name := dns.Fqdn(strings.ToLower(host))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		family int
+		ips    []acl.ResolvedIP
+		err    error
+	}
+	results := make(chan result, 2)
+	for family, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		go func() {
+			ips, err := r.lookup(ctx, name, qtype)
+			results <- result{family, ips, err}
+		}()
+	}
+
+	var ips [2][]acl.ResolvedIP
+	var firstErr error
+	var raceTimer <-chan time.Time
+	for pending := 2; pending > 0; {
+		select {
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				if firstErr == nil {
+					firstErr = res.err
+				}
+				continue
+			}
+			ips[res.family] = res.ips
+			if len(res.ips) > 0 && pending > 0 {
+				t := time.NewTimer(r.opts.RaceDelay)
+				defer t.Stop()
+				raceTimer = t.C
+			}
+		case <-raceTimer:
+			pending = 0
+		}
+	}
+	if all := append(ips[0], ips[1]...); len(all) > 0 {
+		return all, nil
+	}
+	if firstErr != nil {
+		return nil, &net.DNSError{Err: firstErr.Error(), Name: host, IsTimeout: isTimeout(firstErr)}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// Purge drops all cached answers.
+func (r *Resolver) Purge() {
+	r.cache.Purge()
+}
+
+// lookup returns the addresses of one type, from the cache if possible.
+// A negative answer returns no addresses and no error.
+func (r *Resolver) lookup(ctx context.Context, name string, qtype uint16) ([]acl.ResolvedIP, error) {
+	key := cacheKey{name, qtype}
+	if e, ok := r.cache.Get(key); ok {
+		if left := e.expires.Sub(r.now()); left > 0 {
+			return withTTL(e.ips, left), nil
+		}
+		r.cache.Remove(key)
+	}
+
+	// The query goes on when the caller gives up, as others may be waiting
+	// for it, and its answer is cached either way.
+	ch := r.flight.DoChan(name+"/"+dns.TypeToString[qtype], func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.opts.Timeout)
+		defer cancel()
+		return r.query(ctx, key)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		a := res.Val.(queryResult)
+		return withTTL(a.ips, a.ttl), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// query asks the upstreams for the addresses of one type, and caches them.
+func (r *Resolver) query(ctx context.Context, key cacheKey) (queryResult, error) {
+	name, qtype := key.name, key.qtype
+	now := r.now()
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.SetEdns0(udpSize, false)
+	resp, err := r.exchange(ctx, m)
+	if err != nil {
+		return queryResult{}, err
+	}
+	ips, ttl := addresses(resp, qtype)
+	if len(ips) == 0 {
+		ttl = r.negativeTTL(resp)
+	} else if r.opts.MinTTL > 0 && ttl < r.opts.MinTTL {
+		ttl = r.opts.MinTTL
+	}
+	if r.opts.MaxTTL > 0 && ttl > r.opts.MaxTTL {
+		ttl = r.opts.MaxTTL
+	}
+	if ttl > 0 {
+		r.cache.Add(key, &cacheEntry{ips: ips, expires: now.Add(ttl)})
+	}
+	return queryResult{ips, ttl}, nil
+}
+
+// exchange sends m to all upstreams at once, and returns the first answer
+// that is either a success or NXDOMAIN.
+func (r *Resolver) exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type answer struct {
+		resp *dns.Msg
+		err  error
+	}
+	answers := make(chan answer, len(r.upstreams))
+	for _, u := range r.upstreams {
+		go func() {
+			resp, err := u.Exchange(ctx, m.Copy())
+			if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+				err = fmt.Errorf("%s: %s", u, dns.RcodeToString[resp.Rcode])
+			}
+			answers <- answer{resp, err}
+		}()
+	}
+	var firstErr error
+	for range r.upstreams {
+		a := <-answers
+		if a.err == nil {
+			return a.resp, nil
+		}
+		if firstErr == nil {
+			firstErr = a.err
+		}
+	}
+	return nil, firstErr
+}
+
+// addresses returns the addresses of type qtype in resp, and the lowest TTL
+// of the records that lead to them, CNAMEs included.
+func addresses(resp *dns.Msg, qtype uint16) ([]net.IP, time.Duration) {
+	var ips []net.IP
+	var ttl uint32
+	first := true
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if qtype != dns.TypeA {
+				continue
+			}
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			if qtype != dns.TypeAAAA {
+				continue
+			}
+			ips = append(ips, rr.AAAA)
+		case *dns.CNAME:
+		default:
+			continue
+		}
+		if first || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			first = false
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second
+}
+
+// negativeTTL returns how long an answer without addresses may be cached:
+// the lower of the TTL and the minimum field of the SOA record that comes
+// with it (RFC 2308 section 5), or NegativeTTL if there is none.
+func (r *Resolver) negativeTTL(resp *dns.Msg) time.Duration {
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+		}
+	}
+	return r.opts.NegativeTTL
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func withTTL(ips []net.IP, ttl time.Duration) []acl.ResolvedIP {
+	resolved := make([]acl.ResolvedIP, len(ips))
+	for i, ip := range ips {
+		resolved[i] = acl.ResolvedIP{IP: ip, TTL: ttl}
+	}
+	return resolved
+}
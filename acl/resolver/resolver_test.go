@@ -0,0 +1,395 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testZone answers from a fixed table: name -> records. Names that aren't in
+// it get NXDOMAIN with a SOA of 60 seconds.
+type testZone struct {
+	records map[string][]string
+	queries atomic.Int32
+	// delay holds back answers of a type.
+	delay map[uint16]time.Duration
+	// truncate makes UDP answers truncated and empty.
+	truncate bool
+}
+
+func (z *testZone) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	z.queries.Add(1)
+	q := req.Question[0]
+	time.Sleep(z.delay[q.Qtype])
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp && z.truncate {
+		resp.Truncated = true
+		_ = w.WriteMsg(resp)
+		return
+	}
+	records, ok := z.records[q.Name]
+	if !ok {
+		resp.Rcode = dns.RcodeNameError
+		soa, _ := dns.NewRR(q.Name + " 300 IN SOA ns. admin. 1 2 3 4 60")
+		resp.Ns = append(resp.Ns, soa)
+	}
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err)
+		}
+		if rr.Header().Rrtype == q.Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+	_ = w.WriteMsg(resp)
+}
+
+// startUDPTCP serves h over UDP and TCP on the same local port.
+func startUDPTCP(t *testing.T, h dns.Handler) string {
+	t.Helper()
+	for range 10 {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		l, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err != nil {
+			_ = pc.Close()
+			continue
+		}
+		startServer(t, &dns.Server{PacketConn: pc, Handler: h})
+		startServer(t, &dns.Server{Listener: l, Handler: h})
+		return pc.LocalAddr().String()
+	}
+	t.Fatal("no free port")
+	return ""
+}
+
+func startServer(t *testing.T, srv *dns.Server) {
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+	<-started
+	t.Cleanup(func() {
+		_ = srv.Shutdown()
+	})
+}
+
+func testZoneRecords() map[string][]string {
+	return map[string][]string{
+		"example.test.": {
+			"example.test. 300 IN A 192.0.2.1",
+			"example.test. 120 IN A 192.0.2.2",
+			"example.test. 600 IN AAAA 2001:db8::1",
+		},
+		"www.example.test.": {
+			"www.example.test. 30 IN CNAME example.test.",
+			"example.test. 300 IN A 192.0.2.1",
+		},
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"1.1.1.1", "udp://1.1.1.1:53"},
+		{"udp://1.1.1.1:5353", "udp://1.1.1.1:5353"},
+		{"tcp://[2606:4700::1111]", "tcp://[2606:4700::1111]:53"},
+		{"tls://dns.google", "tls://dns.google:853"},
+		{"https://dns.google/dns-query", "https://dns.google/dns-query"},
+	}
+	for _, tt := range tests {
+		u, err := ParseUpstream(tt.s, UpstreamOptions{})
+		assert.NoError(t, err, tt.s)
+		assert.Equal(t, tt.want, u.String())
+	}
+	for _, s := range []string{"quic://dns.google", "udp://", "https://:443"} {
+		_, err := ParseUpstream(s, UpstreamOptions{})
+		assert.Error(t, err, s)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	zone := &testZone{records: testZoneRecords()}
+	addr := startUDPTCP(t, zone)
+	r, err := New(Options{Upstreams: []string{addr}, MinTTL: time.Minute})
+	assert.NoError(t, err)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	ips, err := r.Resolve(ctx, "Example.test")
+	assert.NoError(t, err)
+	if assert.Len(t, ips, 3) {
+		assert.Equal(t, "192.0.2.1", ips[0].IP.String())
+		assert.Equal(t, "192.0.2.2", ips[1].IP.String())
+		assert.Equal(t, 120*time.Second, ips[0].TTL)
+		assert.Equal(t, "2001:db8::1", ips[2].IP.String())
+		assert.Equal(t, 600*time.Second, ips[2].TTL)
+	}
+	assert.Equal(t, int32(2), zone.queries.Load())
+
+	// Cached with the TTL counting down.
+	now = now.Add(100 * time.Second)
+	ips, err = r.Resolve(ctx, "example.test.")
+	assert.NoError(t, err)
+	assert.Equal(t, 20*time.Second, ips[0].TTL)
+	assert.Equal(t, int32(2), zone.queries.Load())
+
+	// The CNAME TTL counts, raised to MinTTL. AAAA is a cached negative
+	// answer without SOA.
+	ips, err = r.Resolve(ctx, "www.example.test")
+	assert.NoError(t, err)
+	if assert.Len(t, ips, 1) {
+		assert.Equal(t, time.Minute, ips[0].TTL)
+	}
+	assert.Equal(t, int32(4), zone.queries.Load())
+	_, err = r.Resolve(ctx, "www.example.test")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(4), zone.queries.Load())
+
+	// NXDOMAIN is cached for the SOA minimum.
+	_, err = r.Resolve(ctx, "missing.test")
+	var dnsErr *net.DNSError
+	if assert.ErrorAs(t, err, &dnsErr) {
+		assert.True(t, dnsErr.IsNotFound)
+	}
+	assert.Equal(t, int32(6), zone.queries.Load())
+	_, err = r.Resolve(ctx, "missing.test")
+	assert.Error(t, err)
+	assert.Equal(t, int32(6), zone.queries.Load())
+	now = now.Add(61 * time.Second)
+	_, err = r.Resolve(ctx, "missing.test")
+	assert.Error(t, err)
+	assert.Equal(t, int32(8), zone.queries.Load())
+
+	ips, err = r.Resolve(ctx, "192.0.2.9")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.9", ips[0].IP.String())
+}
+
+func TestResolverTCPFallback(t *testing.T) {
+	zone := &testZone{records: testZoneRecords(), truncate: true}
+	addr := startUDPTCP(t, zone)
+	r, err := New(Options{Upstreams: []string{"udp://" + addr}})
+	assert.NoError(t, err)
+	ips, err := r.Resolve(context.Background(), "example.test")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 3)
+	// Once over UDP, once over TCP, for A and AAAA each.
+	assert.Equal(t, int32(4), zone.queries.Load())
+}
+
+func TestResolverParallelUpstreams(t *testing.T) {
+	// Swallows all queries.
+	blackhole, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer blackhole.Close()
+	addr := startUDPTCP(t, &testZone{records: testZoneRecords()})
+
+	r, err := New(Options{
+		Upstreams:       []string{blackhole.LocalAddr().String(), addr},
+		UpstreamOptions: UpstreamOptions{Timeout: 5 * time.Second},
+	})
+	assert.NoError(t, err)
+	start := time.Now()
+	ips, err := r.Resolve(context.Background(), "example.test")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 3)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The blackhole alone times out with the context.
+	r, err = New(Options{Upstreams: []string{blackhole.LocalAddr().String()}})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = r.Resolve(ctx, "example.test")
+	var dnsErr *net.DNSError
+	if assert.ErrorAs(t, err, &dnsErr) {
+		assert.True(t, dnsErr.IsTimeout)
+	}
+}
+
+func TestResolverRace(t *testing.T) {
+	zone := &testZone{
+		records: testZoneRecords(),
+		delay:   map[uint16]time.Duration{dns.TypeAAAA: 500 * time.Millisecond},
+	}
+	addr := startUDPTCP(t, zone)
+	r, err := New(Options{Upstreams: []string{addr}, RaceDelay: 20 * time.Millisecond})
+	assert.NoError(t, err)
+	start := time.Now()
+	ips, err := r.Resolve(context.Background(), "example.test")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 2)
+	assert.Less(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestResolverSharedLookups(t *testing.T) {
+	zone := &testZone{
+		records: testZoneRecords(),
+		delay:   map[uint16]time.Duration{dns.TypeA: 100 * time.Millisecond, dns.TypeAAAA: 100 * time.Millisecond},
+	}
+	addr := startUDPTCP(t, zone)
+	r, err := New(Options{Upstreams: []string{addr}})
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := r.Resolve(context.Background(), "example.test")
+			assert.NoError(t, err)
+			assert.Len(t, ips, 3)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), zone.queries.Load())
+
+	// A caller giving up doesn't fail the others.
+	zone.queries.Store(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := r.Resolve(ctx, "www.example.test")
+		assert.Error(t, err)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	ips, err := r.Resolve(context.Background(), "www.example.test")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 1)
+	<-done
+	assert.Equal(t, int32(2), zone.queries.Load())
+}
+
+// countingListener counts the accepted connections.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestDNSUpstreamReuse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	cl := &countingListener{Listener: l}
+	idle := 200 * time.Millisecond
+	startServer(t, &dns.Server{
+		Listener:    cl,
+		Handler:     &testZone{records: testZoneRecords()},
+		IdleTimeout: func() time.Duration { return idle },
+	})
+
+	u, err := ParseUpstream("tcp://"+l.Addr().String(), UpstreamOptions{})
+	assert.NoError(t, err)
+	query := func(name string) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		r, err := u.Exchange(context.Background(), m)
+		assert.NoError(t, err)
+		assert.Equal(t, m.Id, r.Id)
+	}
+	query("example.test.")
+	query("www.example.test.")
+	query("missing.test.")
+	assert.Equal(t, int32(1), cl.accepted.Load())
+
+	// The server closed the idle connection, a new one is made.
+	time.Sleep(2 * idle)
+	query("example.test.")
+	assert.Equal(t, int32(2), cl.accepted.Load())
+}
+
+func TestResolverDoH(t *testing.T) {
+	zone := &testZone{records: testZoneRecords()}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != dohContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bs, _ := io.ReadAll(req.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(bs); err != nil || q.Id != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rec := &dohResponseWriter{}
+		zone.ServeDNS(rec, q)
+		out, _ := rec.msg.Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write(out)
+	}))
+	defer srv.Close()
+
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	r, err := New(Options{
+		Upstreams:       []string{srv.URL + "/dns-query"},
+		UpstreamOptions: UpstreamOptions{TLSConfig: tlsConfig},
+	})
+	assert.NoError(t, err)
+	ips, err := r.Resolve(context.Background(), "example.test")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 3)
+}
+
+func TestResolverDoT(t *testing.T) {
+	// Borrow the certificate of an httptest server.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	serverConfig := &tls.Config{Certificates: srv.TLS.Certificates}
+	startServer(t, &dns.Server{
+		Listener: tls.NewListener(l, serverConfig),
+		Net:      "tcp-tls",
+		Handler:  &testZone{records: testZoneRecords()},
+	})
+
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	r, err := New(Options{
+		Upstreams:       []string{"tls://" + l.Addr().String()},
+		UpstreamOptions: UpstreamOptions{TLSConfig: tlsConfig},
+	})
+	assert.NoError(t, err)
+	ips, err := r.Resolve(context.Background(), "example.test")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 3)
+}
+
+// dohResponseWriter captures the answer of a dns.Handler.
+type dohResponseWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
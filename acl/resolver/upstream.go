@@ -0,0 +1,315 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/belowLevel/route_rule/acl"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultUpstreamTimeout = 5 * time.Second
+	// udpSize is the EDNS0 buffer size recommended by DNS Flag Day 2020,
+	// which avoids IP fragmentation.
+	udpSize = 1232
+
+	dohContentType = "application/dns-message"
+
+	// maxIdleConns is how many TCP or TLS connections an upstream keeps open
+	// for the next queries.
+	maxIdleConns = 4
+	// idleConnTimeout is how long an idle connection is kept. Servers close
+	// them after about that long (RFC 7766 section 6.2.3).
+	idleConnTimeout = 10 * time.Second
+)
+
+// Upstream is a DNS server that queries are sent to.
+type Upstream interface {
+	// Exchange sends a query and returns the answer. The ID of the answer
+	// matches the one of the query.
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+	String() string
+}
+
+// DialFunc connects to upstreams, like net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// UpstreamOptions controls how upstreams are connected to.
+type UpstreamOptions struct {
+	// Dial defaults to a net.Dialer.
+	Dial DialFunc
+	// Outbound, if set, is what upstreams are dialed through instead of
+	// Dial, so that lookups take the same path as the traffic. See
+	// OutboundDial.
+	Outbound acl.Outbound
+	// TLSConfig is used by DNS over TLS and HTTPS. The ServerName defaults to
+	// the host of the upstream.
+	TLSConfig *tls.Config
+	// Timeout limits each exchange, in addition to the context.
+	// Defaults to 5 seconds.
+	Timeout time.Duration
+}
+
+// ParseUpstream parses one of:
+//
+//	1.1.1.1, udp://1.1.1.1:53        DNS over UDP, retried over TCP if truncated
+//	tcp://1.1.1.1                    DNS over TCP
+//	tls://dns.google                 DNS over TLS (port 853)
+//	https://dns.google/dns-query     DNS over HTTPS (RFC 8484)
+//
+// Upstreams named by host are resolved by the dialer.
+func ParseUpstream(s string, opts UpstreamOptions) (Upstream, error) {
+	if opts.Outbound != nil {
+		opts.Dial = OutboundDial(opts.Outbound)
+	}
+	if opts.Dial == nil {
+		d := &net.Dialer{}
+		opts.Dial = d.DialContext
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultUpstreamTimeout
+	}
+	if !strings.Contains(s, "://") {
+		s = "udp://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %s: %w", s, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid upstream %s: no host", s)
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+		port := "53"
+		if u.Scheme == "tls" {
+			port = "853"
+		}
+		if u.Port() != "" {
+			port = u.Port()
+		}
+		return &dnsUpstream{
+			network:   u.Scheme,
+			addr:      net.JoinHostPort(u.Hostname(), port),
+			dial:      opts.Dial,
+			tlsConfig: tlsConfigFor(opts.TLSConfig, u.Hostname()),
+			timeout:   opts.Timeout,
+		}, nil
+	case "https":
+		transport := &http.Transport{
+			DialContext:       opts.Dial,
+			TLSClientConfig:   tlsConfigFor(opts.TLSConfig, u.Hostname()),
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		}
+		return &httpsUpstream{
+			url:    u.String(),
+			client: &http.Client{Transport: transport, Timeout: opts.Timeout},
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid upstream %s: unsupported scheme %s", s, u.Scheme)
+}
+
+func tlsConfigFor(config *tls.Config, host string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if config.ClientSessionCache == nil {
+		// Resume sessions on new connections, saving a round trip.
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return config
+}
+
+// dnsUpstream speaks plain DNS over UDP, TCP or TLS. TCP and TLS connections
+// are kept open and reused, one query at a time.
+type dnsUpstream struct {
+	network   string // udp, tcp or tls
+	addr      string
+	dial      DialFunc
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mu   sync.Mutex
+	idle []idleConn // most recently used last
+}
+
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+func (u *dnsUpstream) String() string {
+	return u.network + "://" + u.addr
+}
+
+func (u *dnsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	r, err := u.exchange(ctx, u.network, m)
+	if err == nil && r.Truncated && u.network == "udp" {
+		return u.exchange(ctx, "tcp", m)
+	}
+	return r, err
+}
+
+func (u *dnsUpstream) exchange(ctx context.Context, network string, m *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+	if network != "udp" {
+		// The server may have closed an idle connection in the meantime,
+		// so a failure on one is tried again on a new connection.
+		if conn := u.getIdle(); conn != nil {
+			r, err := u.exchangeConn(ctx, conn, m, true)
+			if err == nil {
+				return r, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+	}
+	conn, err := u.dialConn(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	return u.exchangeConn(ctx, conn, m, network != "udp")
+}
+
+// exchangeConn sends m over conn. With keep, conn is kept for the next query
+// if it is still usable, otherwise it is closed.
+func (u *dnsUpstream) exchangeConn(ctx context.Context, conn *dns.Conn, m *dns.Msg, keep bool) (*dns.Msg, error) {
+	// The exchange only honors the deadline of ctx, not its cancellation.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	client := &dns.Client{Timeout: u.timeout}
+	r, _, err := client.ExchangeWithConnContext(ctx, m, conn)
+	if !stop() {
+		// Closed already.
+		if err == nil {
+			return r, nil
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if keep {
+		u.putIdle(conn)
+	} else {
+		_ = conn.Close()
+	}
+	return r, nil
+}
+
+func (u *dnsUpstream) dialConn(ctx context.Context, network string) (*dns.Conn, error) {
+	dialNetwork := network
+	if network == "tls" {
+		dialNetwork = "tcp"
+	}
+	conn, err := u.dial(ctx, dialNetwork, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tls" {
+		tlsConn := tls.Client(conn, u.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return &dns.Conn{Conn: conn, UDPSize: udpSize}, nil
+}
+
+// getIdle returns the most recently used idle connection, or nil if there is
+// none that is fresh enough.
+func (u *dnsUpstream) getIdle() *dns.Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for len(u.idle) > 0 {
+		c := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+		if time.Since(c.since) < idleConnTimeout {
+			return c.conn
+		}
+		_ = c.conn.Close()
+	}
+	return nil
+}
+
+func (u *dnsUpstream) putIdle(conn *dns.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idle) >= maxIdleConns {
+		_ = u.idle[0].conn.Close()
+		u.idle = slices.Delete(u.idle, 0, 1)
+	}
+	u.idle = append(u.idle, idleConn{conn, time.Now()})
+}
+
+// httpsUpstream speaks DNS over HTTPS.
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 4.1: use ID 0, so that equal queries can be cached by HTTP.
+	q := m.Copy()
+	q.Id = 0
+	bs, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %s", u.url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(body); err != nil {
+		return nil, err
+	}
+	if len(r.Question) == 0 || !strings.EqualFold(r.Question[0].Name, m.Question[0].Name) {
+		return nil, errors.New(u.url + ": answer doesn't match the query")
+	}
+	r.Id = m.Id
+	return r, nil
+}
@@ -0,0 +1,361 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingResolver answers from a fixed table and counts the lookups.
+type countingResolver struct {
+	ips     map[string][]ResolvedIP
+	lookups atomic.Int32
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, host string) ([]ResolvedIP, error) {
+	r.lookups.Add(1)
+	if ips, ok := r.ips[host]; ok {
+		return ips, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func TestCachingResolver(t *testing.T) {
+	upstream := &countingResolver{ips: map[string][]ResolvedIP{
+		"a.com": {
+			{IP: net.ParseIP("1.1.1.1"), TTL: 30 * time.Second},
+			{IP: net.ParseIP("2001:db8::1"), TTL: 10 * time.Second},
+		},
+		"b.com": {{IP: net.ParseIP("2.2.2.2")}},
+		"c.com": {{IP: net.ParseIP("3.3.3.3"), TTL: time.Second}},
+	}}
+	r, err := NewCachingResolver(upstream, CachingResolverOptions{
+		MinTTL:      5 * time.Second,
+		NegativeTTL: 2 * time.Second,
+	})
+	assert.NoError(t, err)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	ips, err := r.Resolve(ctx, "a.com")
+	assert.NoError(t, err)
+	assert.Len(t, ips, 2)
+	assert.Equal(t, 10*time.Second, ips[0].TTL)
+	assert.Equal(t, int32(1), upstream.lookups.Load())
+
+	// Cached, case and trailing dot don't matter.
+	now = now.Add(4 * time.Second)
+	ips, err = r.Resolve(ctx, "A.com.")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.1", ips[0].IP.String())
+	assert.Equal(t, 6*time.Second, ips[0].TTL)
+	assert.Equal(t, int32(1), upstream.lookups.Load())
+
+	// Expires with the shortest TTL.
+	now = now.Add(6 * time.Second)
+	_, err = r.Resolve(ctx, "a.com")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), upstream.lookups.Load())
+
+	// No TTL uses the default, short ones are raised to MinTTL.
+	ips, err = r.Resolve(ctx, "b.com")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultResolverTTL, ips[0].TTL)
+	ips, err = r.Resolve(ctx, "c.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Second, ips[0].TTL)
+
+	// Failures are cached for NegativeTTL.
+	upstream.lookups.Store(0)
+	_, err = r.Resolve(ctx, "d.com")
+	assert.Error(t, err)
+	_, err = r.Resolve(ctx, "d.com")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), upstream.lookups.Load())
+	now = now.Add(3 * time.Second)
+	_, err = r.Resolve(ctx, "d.com")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), upstream.lookups.Load())
+
+	r.Purge()
+	_, err = r.Resolve(ctx, "b.com")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), upstream.lookups.Load())
+}
+
+func TestHostsResolver(t *testing.T) {
+	hosts, err := ParseHosts(strings.NewReader(`
+# comment
+127.0.0.1   localhost   Example.Test
+::1         localhost ip6-localhost # trailing comment
+not-an-ip   bad.test
+10.0.0.1
+`))
+	assert.NoError(t, err)
+	assert.Len(t, hosts, 3)
+	assert.Len(t, hosts["localhost"], 2)
+
+	upstream := &countingResolver{ips: map[string][]ResolvedIP{
+		"other.test": {{IP: net.ParseIP("192.0.2.1")}},
+	}}
+	r := NewHostsResolver(hosts, upstream)
+	ctx := context.Background()
+
+	ips, err := LookupIP(ctx, r, "example.test")
+	assert.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("127.0.0.1")}, ips)
+
+	resolved, err := r.Resolve(ctx, "localhost")
+	assert.NoError(t, err)
+	assert.Len(t, resolved, 2)
+	assert.Equal(t, defaultHostsTTL, resolved[0].TTL)
+
+	ips, err = LookupIP(ctx, r, "other.test")
+	assert.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.1")}, ips)
+	assert.Equal(t, int32(1), upstream.lookups.Load())
+
+	_, err = NewHostsResolver(hosts, nil).Resolve(ctx, "other.test")
+	var dnsErr *net.DNSError
+	assert.ErrorAs(t, err, &dnsErr)
+	assert.True(t, dnsErr.IsNotFound)
+}
+
+func TestCompileWithResolver(t *testing.T) {
+	l := &GeoLoaderT{
+		MMDBSource: &GeoSource{Bytes: testMMDB(t, map[string]any{
+			"1.0.0.0/16": testCountry("US"),
+			"2.0.0.0/16": testCountry("FR"),
+		})},
+	}
+	defer l.CloseMMdb()
+	resolver := NewHostsResolver(map[string][]net.IP{
+		"us.test": {net.ParseIP("1.0.0.1")},
+		"fr.test": {net.ParseIP("2.0.0.1")},
+	}, nil)
+	rs, err := CompileWithOptions([]TextRule{
+		{Outbound: "test", Address: "geoip:us", ProtoPort: "*", Txt: "test(geoip:us)"},
+	}, map[string]*testOutbound{"test": {"test"}}, CompileOptions{
+		CacheSize: 16,
+		GeoLoader: l,
+		Resolver:  resolver,
+	})
+	assert.NoError(t, err)
+
+	reqAddr := &AddrEx{Host: "us.test", HostInfo: &HostInfo{}}
+	assert.NotNil(t, rs.Match(reqAddr))
+	assert.Equal(t, "1.0.0.1", reqAddr.HostInfo.IPv4.String())
+	assert.Nil(t, rs.Match(&AddrEx{Host: "fr.test", HostInfo: &HostInfo{}}))
+
+	reqAddr = &AddrEx{Host: "unknown.test", HostInfo: &HostInfo{}}
+	assert.Nil(t, rs.Match(reqAddr))
+	assert.Error(t, reqAddr.Err)
+}
+
+func TestCompileAddrMatch(t *testing.T) {
+	l := &GeoLoaderT{
+		MMDBSource: &GeoSource{Bytes: testMMDB(t, map[string]any{
+			"1.0.0.0/16": testCountry("US"),
+			"2.0.0.0/16": testCountry("FR"),
+		})},
+	}
+	defer l.CloseMMdb()
+	resolver := NewHostsResolver(map[string][]net.IP{
+		// A CDN with addresses in both.
+		"cdn.test": {net.ParseIP("1.0.0.1"), net.ParseIP("2.0.0.1")},
+		"us.test":  {net.ParseIP("1.0.0.1"), net.ParseIP("1.0.0.2")},
+	}, nil)
+	compile := func(mode AddrMatchMode) CompiledRuleSet[*testOutbound] {
+		rs, err := CompileWithOptions([]TextRule{
+			{Outbound: "test", Address: "geoip:fr", ProtoPort: "*", Txt: "test(geoip:fr)"},
+			{Outbound: "test", Address: "2.0.0.0/16", ProtoPort: "*", Txt: "test(2.0.0.0/16)"},
+		}, map[string]*testOutbound{"test": {"test"}}, CompileOptions{
+			CacheSize: 16,
+			GeoLoader: l,
+			Resolver:  resolver,
+			AddrMatch: mode,
+		})
+		assert.NoError(t, err)
+		return rs
+	}
+
+	rs := compile(AddrMatchAny)
+	reqAddr := &AddrEx{Host: "cdn.test", HostInfo: &HostInfo{}}
+	assert.NotNil(t, rs.Match(reqAddr))
+	assert.Equal(t, "test(geoip:fr)", reqAddr.Txt)
+	assert.Len(t, reqAddr.HostInfo.IPs, 2)
+	assert.Nil(t, rs.Match(&AddrEx{Host: "us.test", HostInfo: &HostInfo{}}))
+
+	rs = compile(AddrMatchAll)
+	assert.Nil(t, rs.Match(&AddrEx{Host: "cdn.test", HostInfo: &HostInfo{}}))
+}
+
+func TestAddrExResolve(t *testing.T) {
+	upstream := &countingResolver{ips: map[string][]ResolvedIP{
+		"v6.test": {{IP: net.ParseIP("2001:db8::1"), TTL: time.Minute}},
+	}}
+	ctx := context.Background()
+
+	// IPv6 only, resolved once.
+	reqAddr := &AddrEx{Host: "v6.test", HostInfo: &HostInfo{}}
+	assert.NoError(t, reqAddr.Resolve(ctx, upstream))
+	assert.NoError(t, reqAddr.Resolve(ctx, upstream))
+	assert.Nil(t, reqAddr.HostInfo.IPv4)
+	assert.Equal(t, "2001:db8::1", reqAddr.HostInfo.IPv6.String())
+	assert.Equal(t, ResolveSourceResolver, reqAddr.HostInfo.Source)
+	assert.True(t, reqAddr.HostInfo.Resolved())
+	assert.Equal(t, int32(1), upstream.lookups.Load())
+
+	// So are failures.
+	reqAddr = &AddrEx{Host: "unknown.test"}
+	assert.Error(t, reqAddr.Resolve(ctx, upstream))
+	assert.Error(t, reqAddr.Resolve(ctx, upstream))
+	assert.Equal(t, reqAddr.HostInfo.ResolveErr, reqAddr.Err)
+	assert.Equal(t, int32(2), upstream.lookups.Load())
+
+	reqAddr = &AddrEx{Host: "2001:db8::2", HostInfo: &HostInfo{}}
+	assert.NoError(t, reqAddr.Resolve(ctx, upstream))
+	assert.Equal(t, ResolveSourceLiteral, reqAddr.HostInfo.Source)
+	assert.Equal(t, "2001:db8::2", reqAddr.HostInfo.IPv6.String())
+
+	reqAddr = &AddrEx{Host: "v6.test", HostInfo: &HostInfo{IPv6: net.ParseIP("2001:db8::3")}}
+	assert.NoError(t, reqAddr.Resolve(ctx, upstream))
+	assert.Equal(t, ResolveSourceCaller, reqAddr.HostInfo.Source)
+	assert.Equal(t, "2001:db8::3", reqAddr.HostInfo.IPv6.String())
+	assert.Equal(t, int32(2), upstream.lookups.Load())
+}
+
+func TestCompileResolveOnce(t *testing.T) {
+	l := &GeoLoaderT{
+		MMDBSource: &GeoSource{Bytes: testMMDB(t, map[string]any{
+			"2.0.0.0/16": testCountry("FR"),
+		})},
+	}
+	defer l.CloseMMdb()
+	upstream := &countingResolver{ips: map[string][]ResolvedIP{
+		"v6.test": {{IP: net.ParseIP("2001:db8::1")}},
+	}}
+	rs, err := CompileWithOptions([]TextRule{
+		{Outbound: "test", Address: "geoip:us", ProtoPort: "*", Txt: "test(geoip:us)"},
+		{Outbound: "test", Address: "geoip:de", ProtoPort: "*", Txt: "test(geoip:de)"},
+		{Outbound: "test", Address: "geoip:fr", ProtoPort: "*", Txt: "test(geoip:fr)"},
+		{Outbound: "test", Address: "2001:db8::/32", ProtoPort: "*", Txt: "test(2001:db8::/32)"},
+	}, map[string]*testOutbound{"test": {"test"}}, CompileOptions{
+		CacheSize: 16,
+		GeoLoader: l,
+		Resolver:  upstream,
+	})
+	assert.NoError(t, err)
+
+	reqAddr := &AddrEx{Host: "v6.test", HostInfo: &HostInfo{}}
+	assert.NotNil(t, rs.Match(reqAddr))
+	// The IPv6 address made it past the geoip rules, looked up once.
+	assert.Equal(t, "test(2001:db8::/32)", reqAddr.Txt)
+	assert.Equal(t, int32(1), upstream.lookups.Load())
+}
+
+// blockingResolver never answers, until the context is done.
+type blockingResolver struct {
+	lookups atomic.Int32
+}
+
+func (r *blockingResolver) Resolve(ctx context.Context, host string) ([]ResolvedIP, error) {
+	r.lookups.Add(1)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestMatchContextTimeout(t *testing.T) {
+	l := &GeoLoaderT{
+		MMDBSource: &GeoSource{Bytes: testMMDB(t, map[string]any{
+			"1.0.0.0/16": testCountry("US"),
+		})},
+	}
+	defer l.CloseMMdb()
+	resolver := &blockingResolver{}
+	compile := func(timeout time.Duration, policy ResolveTimeoutPolicy) CompiledRuleSet[*testOutbound] {
+		rs, err := CompileWithOptions([]TextRule{
+			{Outbound: "us", Address: "geoip:us", ProtoPort: "*", Txt: "us(geoip:us)"},
+			{Outbound: "other", Address: "all", ProtoPort: "*", Txt: "other(all)"},
+		}, map[string]*testOutbound{"us": {"us"}, "other": {"other"}}, CompileOptions{
+			CacheSize:            16,
+			GeoLoader:            l,
+			Resolver:             resolver,
+			ResolveTimeout:       timeout,
+			ResolveTimeoutPolicy: policy,
+		})
+		assert.NoError(t, err)
+		return rs
+	}
+
+	// The deadline of the context is enough.
+	rs := compile(0, ResolveTimeoutFail)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	reqAddr := &AddrEx{Host: "slow.test", HostInfo: &HostInfo{}}
+	assert.Nil(t, rs.MatchContext(ctx, reqAddr))
+	assert.ErrorIs(t, reqAddr.Err, context.DeadlineExceeded)
+
+	rs = compile(20*time.Millisecond, ResolveTimeoutFail)
+	start := time.Now()
+	reqAddr = &AddrEx{Host: "slow.test", HostInfo: &HostInfo{}}
+	assert.Nil(t, rs.Match(reqAddr))
+	assert.ErrorIs(t, reqAddr.Err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	rs = compile(20*time.Millisecond, ResolveTimeoutSkip)
+	resolver.lookups.Store(0)
+	for i := 0; i < 2; i++ {
+		reqAddr = &AddrEx{Host: "slow.test", HostInfo: &HostInfo{}}
+		ob := rs.Match(reqAddr)
+		if assert.NotNil(t, ob) {
+			assert.Equal(t, "other", ob.GetName())
+		}
+		assert.NoError(t, reqAddr.Err)
+		// Left for the outbound to resolve.
+		assert.False(t, reqAddr.HostInfo.Resolved())
+	}
+	// Not cached.
+	assert.Equal(t, int32(2), resolver.lookups.Load())
+}
+
+func TestMatchContextCanceled(t *testing.T) {
+	l := &GeoLoaderT{
+		MMDBSource: &GeoSource{Bytes: testMMDB(t, map[string]any{
+			"1.0.0.0/16": testCountry("US"),
+		})},
+	}
+	defer l.CloseMMdb()
+	resolver := &blockingResolver{}
+	rs, err := CompileWithOptions([]TextRule{
+		{Outbound: "us", Address: "geoip:us", ProtoPort: "*", Txt: "us(geoip:us)"},
+		{Outbound: "other", Address: "all", ProtoPort: "*", Txt: "other(all)"},
+	}, map[string]*testOutbound{"us": {"us"}, "other": {"other"}}, CompileOptions{
+		CacheSize: 16,
+		GeoLoader: l,
+		Resolver:  resolver,
+	})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	reqAddr := &AddrEx{Host: "slow.test", HostInfo: &HostInfo{}}
+	assert.Nil(t, rs.MatchContext(ctx, reqAddr))
+	assert.ErrorIs(t, reqAddr.Err, context.Canceled)
+	assert.False(t, reqAddr.HostInfo.Resolved())
+
+	// The next request isn't failed by the cancellation of the previous one.
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	reqAddr = &AddrEx{Host: "slow.test", HostInfo: &HostInfo{}}
+	assert.Nil(t, rs.MatchContext(ctx, reqAddr))
+	assert.ErrorIs(t, reqAddr.Err, context.DeadlineExceeded)
+	assert.Equal(t, int32(2), resolver.lookups.Load())
+}
@@ -0,0 +1,57 @@
+package v2geo
+
+import (
+	"iter"
+)
+
+// covers reports whether the Set matches everything the stored key matches:
+// an exact key is covered by any entry matching its domain, a suffix key only
+// by a suffix entry matching its domain.
+func (ss *Set) covers(key string) bool {
+	domain, exact := domainOfKey(key)
+	_, ok := ss.lookup(domain, exact)
+	return ok
+}
+
+func filterKeys(keys iter.Seq[string], keep func(string) bool) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for key := range keys {
+			if keep(key) && !yield(key) {
+				return
+			}
+		}
+	}
+}
+
+// Union returns a Set with the entries of all given Sets.
+func Union(sets ...*Set) *Set {
+	seqs := make([]iter.Seq[string], len(sets))
+	for i, ss := range sets {
+		seqs[i] = ss.rawKeys()
+	}
+	ss, _ := buildSet(mergeSorted(seqs...))
+	return ss
+}
+
+// Intersect returns a Set that matches the domains matched by both a and b.
+// It keeps the entries of each Set that the other one covers, e.g.
+// "google.com" and "mail.google.com" intersect to "mail.google.com".
+func Intersect(a, b *Set) *Set {
+	ss, _ := buildSet(mergeSorted(
+		filterKeys(a.rawKeys(), b.covers),
+		filterKeys(b.rawKeys(), a.covers),
+	))
+	return ss
+}
+
+// DropCovered returns a Set with the entries of a that b doesn't fully cover,
+// e.g. geosite:cn with the entries also found in geosite:google dropped.
+// It is not a set difference: entries of a are kept or dropped as a whole, so
+// when a has "google.com" and b has "mail.google.com", the result still
+// matches "mail.google.com".
+func DropCovered(a, b *Set) *Set {
+	ss, _ := buildSet(filterKeys(a.rawKeys(), func(key string) bool {
+		return !b.covers(key)
+	}))
+	return ss
+}
@@ -0,0 +1,325 @@
+package v2geo
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"iter"
+	"os"
+	"slices"
+)
+
+const defaultMaxMemKeys = 1 << 20
+
+var errKeysNotSorted = errors.New("v2geo: keys are not sorted")
+
+// levelBuf holds one level of the trie while it's being built.
+type levelBuf struct {
+	labels []byte
+	bitmap []uint64
+	nBits  int
+	nNodes int
+	leaves []int // indexes of the leaf nodes within the level
+}
+
+func (l *levelBuf) addLabel(c byte) {
+	l.labels = append(l.labels, c)
+	setBit(&l.bitmap, l.nBits, 0)
+	l.nBits++
+}
+
+func (l *levelBuf) closeNode() {
+	setBit(&l.bitmap, l.nBits, 1)
+	l.nBits++
+}
+
+// trieBuilder builds a Set from keys fed in sorted order.
+// A trie stored level by level visits the nodes of each level in the
+// lexicographic order of their prefixes, so every level can be appended to
+// independently, and only the previous key has to be remembered.
+type trieBuilder struct {
+	levels []*levelBuf
+	prev   string
+	n      int
+}
+
+func (b *trieBuilder) level(d int) *levelBuf {
+	for d >= len(b.levels) {
+		b.levels = append(b.levels, &levelBuf{})
+	}
+	return b.levels[d]
+}
+
+// openNodes starts the nodes below depth lcp for key.
+// Every key ends with a terminal label, so no key is a prefix of another,
+// and the node at depth len(key) is always a leaf.
+func (b *trieBuilder) openNodes(key string, lcp int) {
+	b.level(lcp).addLabel(key[lcp])
+	for d := lcp + 1; d < len(key); d++ {
+		l := b.level(d)
+		l.nNodes++
+		l.addLabel(key[d])
+	}
+	leaf := b.level(len(key))
+	leaf.leaves = append(leaf.leaves, leaf.nNodes)
+	leaf.nNodes++
+}
+
+// closeNodes finishes the nodes of the previous key deeper than lcp.
+func (b *trieBuilder) closeNodes(lcp int) {
+	for d := len(b.prev); d > lcp; d-- {
+		b.levels[d].closeNode()
+	}
+}
+
+func (b *trieBuilder) add(key string) error {
+	if b.n == 0 {
+		b.level(0).nNodes = 1
+		b.openNodes(key, 0)
+	} else {
+		if key <= b.prev {
+			if key == b.prev {
+				return nil
+			}
+			return errKeysNotSorted
+		}
+		lcp := 0
+		for lcp < len(b.prev) && b.prev[lcp] == key[lcp] {
+			lcp++
+		}
+		b.closeNodes(lcp)
+		b.openNodes(key, lcp)
+	}
+	b.prev = key
+	b.n++
+	return nil
+}
+
+func (b *trieBuilder) finish() *Set {
+	if b.n == 0 {
+		b.level(0).nNodes = 1
+	} else {
+		b.closeNodes(0)
+	}
+	b.levels[0].closeNode()
+
+	ss := &Set{}
+	bitOff, nodeOff := 0, 0
+	for _, l := range b.levels {
+		for i := 0; i < l.nBits; i++ {
+			if getBit(l.bitmap, i) != 0 {
+				setBit(&ss.labelBitmap, bitOff+i, 1)
+			} else {
+				setBit(&ss.labelBitmap, bitOff+i, 0)
+			}
+		}
+		for _, i := range l.leaves {
+			setBit(&ss.leaves, nodeOff+i, 1)
+		}
+		ss.labels = append(ss.labels, l.labels...)
+		bitOff += l.nBits
+		nodeOff += l.nNodes
+	}
+	ss.init()
+	return ss
+}
+
+// buildSet builds a Set from stored keys in sorted order.
+// Duplicate keys are skipped.
+func buildSet(keys iter.Seq[string]) (*Set, error) {
+	b := &trieBuilder{}
+	for key := range keys {
+		if err := b.add(key); err != nil {
+			return nil, err
+		}
+	}
+	return b.finish(), nil
+}
+
+// SetBuilder builds a Set from a stream of entries with bounded memory.
+// Entries may come in any order. Once more than MaxMemKeys entries are
+// buffered, they are sorted and spilled to a temporary file, and all runs
+// are merged when Build is called.
+type SetBuilder struct {
+	// MaxMemKeys is the number of entries kept in memory before spilling.
+	// Defaults to 1<<20.
+	MaxMemKeys int
+	// TempDir is where spilled runs go. Defaults to os.TempDir().
+	TempDir string
+
+	buf  []string
+	runs []*os.File
+}
+
+// Add adds an entry, see NewSet for the syntax.
+func (b *SetBuilder) Add(entry string) error {
+	b.buf = append(b.buf, reverseDomainKey(entry))
+	max := b.MaxMemKeys
+	if max <= 0 {
+		max = defaultMaxMemKeys
+	}
+	if len(b.buf) >= max {
+		return b.spill()
+	}
+	return nil
+}
+
+// AddAll adds all entries from an iterator.
+func (b *SetBuilder) AddAll(entries iter.Seq[string]) error {
+	for entry := range entries {
+		if err := b.Add(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *SetBuilder) spill() error {
+	slices.Sort(b.buf)
+	b.buf = slices.Compact(b.buf)
+	f, err := os.CreateTemp(b.TempDir, "sskv-run-*")
+	if err != nil {
+		return err
+	}
+	// The run is only reachable through the open file from now on.
+	_ = os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	var lb [binary.MaxVarintLen64]byte
+	for _, key := range b.buf {
+		n := binary.PutUvarint(lb[:], uint64(len(key)))
+		if _, err := w.Write(lb[:n]); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if _, err := w.WriteString(key); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	b.runs = append(b.runs, f)
+	b.buf = b.buf[:0]
+	return nil
+}
+
+// Build merges everything added so far into a Set.
+// The builder is reset and can be reused afterwards.
+func (b *SetBuilder) Build() (*Set, error) {
+	defer b.Close()
+	slices.Sort(b.buf)
+	seqs := []iter.Seq[string]{slices.Values(b.buf)}
+	var runErr error
+	for _, f := range b.runs {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		seqs = append(seqs, readRun(bufio.NewReader(f), &runErr))
+	}
+	ss, err := buildSet(mergeSorted(seqs...))
+	if err != nil {
+		return nil, err
+	}
+	if runErr != nil {
+		return nil, runErr
+	}
+	return ss, nil
+}
+
+// Close drops everything added so far and removes spilled runs.
+func (b *SetBuilder) Close() error {
+	for _, f := range b.runs {
+		_ = f.Close()
+	}
+	b.runs = nil
+	b.buf = nil
+	return nil
+}
+
+// BuildSet builds a Set from an iterator of entries, see SetBuilder.
+func BuildSet(entries iter.Seq[string]) (*Set, error) {
+	b := &SetBuilder{}
+	if err := b.AddAll(entries); err != nil {
+		_ = b.Close()
+		return nil, err
+	}
+	return b.Build()
+}
+
+func readRun(r *bufio.Reader, errp *error) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for {
+			n, err := binary.ReadUvarint(r)
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				*errp = err
+				return
+			}
+			bs := make([]byte, n)
+			if _, err := io.ReadFull(r, bs); err != nil {
+				*errp = err
+				return
+			}
+			if !yield(string(bs)) {
+				return
+			}
+		}
+	}
+}
+
+type mergeItem struct {
+	key  string
+	next func() (string, bool)
+}
+
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int           { return len(h) }
+func (h mergeHeap) Less(i, j int) bool { return h[i].key < h[j].key }
+func (h mergeHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)        { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mergeSorted merges sorted sequences into one sorted sequence,
+// dropping duplicates.
+func mergeSorted(seqs ...iter.Seq[string]) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		h := make(mergeHeap, 0, len(seqs))
+		for _, seq := range seqs {
+			next, stop := iter.Pull(seq)
+			defer stop()
+			if key, ok := next(); ok {
+				h = append(h, mergeItem{key, next})
+			}
+		}
+		heap.Init(&h)
+		var last string
+		first := true
+		for len(h) > 0 {
+			key := h[0].key
+			if first || key != last {
+				if !yield(key) {
+					return
+				}
+				last, first = key, false
+			}
+			if next, ok := h[0].next(); ok {
+				h[0].key = next
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package v2geo
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetBuilderSpill(t *testing.T) {
+	var entries []string
+	for i := 999; i >= 0; i-- {
+		entries = append(entries, fmt.Sprintf("d%d.example.com", i))
+		if i%3 == 0 {
+			entries = append(entries, fmt.Sprintf("full:x%d.example.org", i))
+		}
+	}
+	entries = append(entries, entries[:100]...) // duplicates across runs
+
+	b := &SetBuilder{MaxMemKeys: 64, TempDir: t.TempDir()}
+	assert.NoError(t, b.AddAll(slices.Values(entries)))
+	assert.NotEmpty(t, b.runs)
+	ss, err := b.Build()
+	assert.NoError(t, err)
+
+	want := NewSet(entries)
+	wantBs, _ := want.MarshalBinary()
+	gotBs, _ := ss.MarshalBinary()
+	assert.Equal(t, wantBs, gotBs)
+	assert.True(t, ss.Has("a.d500.example.com"))
+	assert.True(t, ss.Has("x3.example.org"))
+	assert.False(t, ss.Has("a.x3.example.org"))
+	assert.False(t, ss.Has("x1.example.org"))
+}
+
+func TestBuildSetEmpty(t *testing.T) {
+	ss, err := BuildSet(slices.Values([]string{}))
+	assert.NoError(t, err)
+	assert.False(t, ss.Has("example.com"))
+	assert.Empty(t, slices.Collect(ss.Keys()))
+}
+
+func TestBuildSetUnsorted(t *testing.T) {
+	_, err := buildSet(slices.Values([]string{"b\r", "a\r"}))
+	assert.ErrorIs(t, err, errKeysNotSorted)
+}
+
+func TestSetAlgebra(t *testing.T) {
+	cn := NewSet([]string{"baidu.com", "qq.com", "google.cn", "full:g.cn", "mail.google.com"})
+	google := NewSet([]string{"google.com", "google.cn", "g.cn", "full:youtube.com"})
+
+	u := Union(cn, google)
+	assert.ElementsMatch(t, []string{"baidu.com", "qq.com", "google.cn", "full:g.cn", "mail.google.com",
+		"google.com", "g.cn", "full:youtube.com"}, slices.Collect(u.Keys()))
+
+	i := Intersect(cn, google)
+	assert.ElementsMatch(t, []string{"google.cn", "full:g.cn", "mail.google.com"}, slices.Collect(i.Keys()))
+	assert.True(t, i.Has("mail.google.com"))
+	assert.False(t, i.Has("www.google.com"))
+	assert.False(t, i.Has("www.g.cn"))
+
+	d := DropCovered(cn, google)
+	assert.ElementsMatch(t, []string{"baidu.com", "qq.com"}, slices.Collect(d.Keys()))
+
+	d = DropCovered(google, cn)
+	assert.ElementsMatch(t, []string{"google.com", "g.cn", "full:youtube.com"}, slices.Collect(d.Keys()))
+	assert.True(t, d.Has("mail.google.com"))
+}
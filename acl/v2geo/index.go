@@ -0,0 +1,353 @@
+package v2geo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers from v2geo.proto that the index cares about.
+const (
+	geoSiteListEntryField   = 1 // GeoSiteList.entry
+	geoSiteCountryCodeField = 1 // GeoSite.country_code
+	geoSiteDomainField      = 2 // GeoSite.domain
+	domainTypeField         = 1 // Domain.type
+	domainValueField        = 2 // Domain.value
+)
+
+var errMalformedGeoSite = errors.New("malformed geosite data")
+
+type geoSiteEntry struct {
+	off, n int64
+}
+
+// GeoSiteIndex is a lightweight index over a GeoSite data file.
+// Instead of unmarshalling the whole GeoSiteList, it only records where each
+// category lives in the file, so that only the categories that are actually
+// referenced by rules get decoded and turned into a Set.
+type GeoSiteIndex struct {
+	r       io.ReaderAt
+	closer  io.Closer
+	entries map[string]geoSiteEntry // key: lower case country code
+}
+
+// OpenGeoSiteIndex opens a GeoSite data file and indexes it.
+// The file stays open until Close is called.
+func OpenGeoSiteIndex(filename string) (*GeoSiteIndex, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	x, err := NewGeoSiteIndex(f, info.Size())
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	x.closer = f
+	return x, nil
+}
+
+// OpenGeoSiteIndexFS is like OpenGeoSiteIndex, for a file in fsys, e.g. an
+// embed.FS. Files that can't be read at an offset are read into memory.
+func OpenGeoSiteIndexFS(fsys fs.FS, name string) (*GeoSiteIndex, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		bs, err := io.ReadAll(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return NewGeoSiteIndex(bytes.NewReader(bs), int64(len(bs)))
+	}
+	x, err := NewGeoSiteIndex(ra, info.Size())
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	x.closer = f
+	return x, nil
+}
+
+// NewGeoSiteIndex indexes GeoSite data of the given size read from r.
+// r must stay valid for as long as the index is in use.
+func NewGeoSiteIndex(r io.ReaderAt, size int64) (*GeoSiteIndex, error) {
+	x := &GeoSiteIndex{
+		r:       r,
+		entries: make(map[string]geoSiteEntry),
+	}
+	cr := &countingReader{br: bufio.NewReader(io.NewSectionReader(r, 0, size))}
+	for cr.n < size {
+		num, typ, err := cr.readTag()
+		if err != nil {
+			return nil, err
+		}
+		if num != geoSiteListEntryField || typ != protowire.BytesType {
+			if err := cr.skip(typ); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		n, err := cr.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		off := cr.n
+		code, err := cr.scanCountryCode(int64(n))
+		if err != nil {
+			return nil, err
+		}
+		x.entries[strings.ToLower(code)] = geoSiteEntry{off, int64(n)}
+	}
+	return x, nil
+}
+
+// Names returns the (lower case) names of all categories in the index, sorted.
+func (x *GeoSiteIndex) Names() []string {
+	names := make([]string, 0, len(x.entries))
+	for name := range x.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Has reports whether the index contains the given category.
+func (x *GeoSiteIndex) Has(name string) bool {
+	_, ok := x.entries[name]
+	return ok
+}
+
+// LoadSet decodes a single category and builds a Set from it.
+// Regex domains are not supported by Set and are skipped.
+// Returns nil with no error when the category does not exist or
+// contains no usable domains.
+func (x *GeoSiteIndex) LoadSet(name string) (*Set, error) {
+	e, ok := x.entries[name]
+	if !ok {
+		return nil, nil
+	}
+	bs := make([]byte, e.n)
+	if _, err := x.r.ReadAt(bs, e.off); err != nil {
+		return nil, err
+	}
+	strs, err := geoSiteDomains(bs)
+	if err != nil {
+		return nil, fmt.Errorf("geosite %s: %w", name, err)
+	}
+	if len(strs) == 0 {
+		return nil, nil
+	}
+	return NewSet(strs), nil
+}
+
+// Close closes the underlying file, if the index was opened from one.
+func (x *GeoSiteIndex) Close() error {
+	if x.closer == nil {
+		return nil
+	}
+	return x.closer.Close()
+}
+
+// geoSiteDomains extracts the domain values of a wire-encoded GeoSite
+// message without materializing it.
+func geoSiteDomains(bs []byte) ([]string, error) {
+	var strs []string
+	for len(bs) > 0 {
+		num, typ, n := protowire.ConsumeTag(bs)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		bs = bs[n:]
+		if num != geoSiteDomainField || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, bs)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			bs = bs[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(bs)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		bs = bs[n:]
+		dt, value, err := parseDomain(v)
+		if err != nil {
+			return nil, err
+		}
+		switch dt {
+		case Domain_Plain, Domain_RootDomain:
+			strs = append(strs, value)
+		case Domain_Full:
+			strs = append(strs, PrefixFull+value)
+		}
+	}
+	return strs, nil
+}
+
+func parseDomain(bs []byte) (Domain_Type, string, error) {
+	var dt Domain_Type
+	var value string
+	for len(bs) > 0 {
+		num, typ, n := protowire.ConsumeTag(bs)
+		if n < 0 {
+			return 0, "", protowire.ParseError(n)
+		}
+		bs = bs[n:]
+		switch {
+		case num == domainTypeField && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(bs)
+			if n < 0 {
+				return 0, "", protowire.ParseError(n)
+			}
+			dt = Domain_Type(v)
+			bs = bs[n:]
+		case num == domainValueField && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(bs)
+			if n < 0 {
+				return 0, "", protowire.ParseError(n)
+			}
+			value = string(v)
+			bs = bs[n:]
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, bs)
+			if n < 0 {
+				return 0, "", protowire.ParseError(n)
+			}
+			bs = bs[n:]
+		}
+	}
+	return dt, value, nil
+}
+
+// countingReader is a buffered reader that keeps track of its offset,
+// used to scan the top level of a GeoSiteList without loading it.
+type countingReader struct {
+	br *bufio.Reader
+	n  int64
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+func (r *countingReader) readUvarint() (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, errMalformedGeoSite
+}
+
+func (r *countingReader) readTag() (protowire.Number, protowire.Type, error) {
+	v, err := r.readUvarint()
+	if err != nil {
+		return 0, 0, err
+	}
+	num, typ := protowire.DecodeTag(v)
+	if !num.IsValid() {
+		return 0, 0, errMalformedGeoSite
+	}
+	return num, typ, nil
+}
+
+func (r *countingReader) discard(n int64) error {
+	d, err := r.br.Discard(int(n))
+	r.n += int64(d)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *countingReader) skip(typ protowire.Type) error {
+	switch typ {
+	case protowire.VarintType:
+		_, err := r.readUvarint()
+		return err
+	case protowire.Fixed32Type:
+		return r.discard(4)
+	case protowire.Fixed64Type:
+		return r.discard(8)
+	case protowire.BytesType:
+		n, err := r.readUvarint()
+		if err != nil {
+			return err
+		}
+		return r.discard(int64(n))
+	default:
+		return errMalformedGeoSite
+	}
+}
+
+// scanCountryCode reads the country code of a GeoSite message of length n,
+// skipping over everything else in it.
+func (r *countingReader) scanCountryCode(n int64) (string, error) {
+	end := r.n + n
+	var code string
+	for r.n < end {
+		num, typ, err := r.readTag()
+		if err != nil {
+			return "", err
+		}
+		if num != geoSiteCountryCodeField || typ != protowire.BytesType {
+			if err := r.skip(typ); err != nil {
+				return "", err
+			}
+			continue
+		}
+		l, err := r.readUvarint()
+		if err != nil {
+			return "", err
+		}
+		if l > uint64(end-r.n) {
+			return "", errMalformedGeoSite
+		}
+		bs := make([]byte, l)
+		if _, err := io.ReadFull(r.br, bs); err != nil {
+			return "", err
+		}
+		r.n += int64(l)
+		code = string(bs)
+	}
+	if r.n != end {
+		return "", errMalformedGeoSite
+	}
+	return code, nil
+}
@@ -0,0 +1,100 @@
+package v2geo
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func testGeoSiteData(t testing.TB) []byte {
+	bs, err := proto.Marshal(&GeoSiteList{
+		Entry: []*GeoSite{
+			{
+				CountryCode: "GOOGLE",
+				Domain: []*Domain{
+					{Type: Domain_RootDomain, Value: "google.com"},
+					{Type: Domain_Full, Value: "www.gstatic.com"},
+					{Type: Domain_Regex, Value: `^ggpht\.`},
+				},
+			},
+			{
+				CountryCode: "Apple",
+				Domain: []*Domain{
+					{Type: Domain_RootDomain, Value: "apple.com", Attribute: []*Domain_Attribute{
+						{Key: "cn", TypedValue: &Domain_Attribute_BoolValue{BoolValue: true}},
+					}},
+				},
+			},
+			{
+				CountryCode: "REGEX-ONLY",
+				Domain: []*Domain{
+					{Type: Domain_Regex, Value: `^a+$`},
+				},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	return bs
+}
+
+func TestGeoSiteIndex(t *testing.T) {
+	bs := testGeoSiteData(t)
+	x, err := NewGeoSiteIndex(bytes.NewReader(bs), int64(len(bs)))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"apple", "google", "regex-only"}, x.Names())
+
+	set, err := x.LoadSet("google")
+	assert.NoError(t, err)
+	assert.True(t, set.Has("google.com"))
+	assert.True(t, set.Has("mail.google.com"))
+	assert.True(t, set.Has("www.gstatic.com"))
+	assert.False(t, set.Has("a.www.gstatic.com"))
+	assert.False(t, set.Has("apple.com"))
+
+	set, err = x.LoadSet("apple")
+	assert.NoError(t, err)
+	assert.True(t, set.Has("www.apple.com"))
+
+	set, err = x.LoadSet("regex-only")
+	assert.NoError(t, err)
+	assert.Nil(t, set)
+
+	set, err = x.LoadSet("nope")
+	assert.NoError(t, err)
+	assert.Nil(t, set)
+}
+
+func TestGeoSiteIndexMalformed(t *testing.T) {
+	bs := testGeoSiteData(t)
+	_, err := NewGeoSiteIndex(bytes.NewReader(bs[:len(bs)-3]), int64(len(bs)-3))
+	assert.Error(t, err)
+
+	// a country code longer than its GeoSite message
+	entry := protowire.AppendTag(nil, geoSiteCountryCodeField, protowire.BytesType)
+	entry = protowire.AppendVarint(entry, 1<<40)
+	bs = protowire.AppendTag(nil, geoSiteListEntryField, protowire.BytesType)
+	bs = protowire.AppendBytes(bs, entry)
+	_, err = NewGeoSiteIndex(bytes.NewReader(bs), int64(len(bs)))
+	assert.ErrorIs(t, err, errMalformedGeoSite)
+}
+
+func TestOpenGeoSiteIndexFS(t *testing.T) {
+	fsys := fstest.MapFS{"data/geosite.dat": {Data: testGeoSiteData(t)}}
+	x, err := OpenGeoSiteIndexFS(fsys, "data/geosite.dat")
+	assert.NoError(t, err)
+	defer x.Close()
+	set, err := x.LoadSet("google")
+	assert.NoError(t, err)
+	assert.True(t, set.Has("mail.google.com"))
+
+	_, err = OpenGeoSiteIndexFS(fsys, "missing.dat")
+	assert.Error(t, err)
+
+	m, err := ParseGeoSite(testGeoSiteData(t))
+	assert.NoError(t, err)
+	assert.Contains(t, m, "apple")
+}
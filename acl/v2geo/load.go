@@ -15,6 +15,11 @@ func LoadGeoIP(filename string) (map[string]*GeoIP, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ParseGeoIP(bs)
+}
+
+// ParseGeoIP is like LoadGeoIP, for data already in memory.
+func ParseGeoIP(bs []byte) (map[string]*GeoIP, error) {
 	var list GeoIPList
 	if err := proto.Unmarshal(bs, &list); err != nil {
 		return nil, err
@@ -33,6 +38,11 @@ func LoadGeoSite(filename string) (map[string]*GeoSite, error) {
 	if err != nil {
 		return nil, err
 	}
+	return ParseGeoSite(bs)
+}
+
+// ParseGeoSite is like LoadGeoSite, for data already in memory.
+func ParseGeoSite(bs []byte) (map[string]*GeoSite, error) {
 	var list GeoSiteList
 	if err := proto.Unmarshal(bs, &list); err != nil {
 		return nil, err
@@ -44,37 +54,25 @@ func LoadGeoSite(filename string) (map[string]*GeoSite, error) {
 	return m, nil
 }
 
+// LoadGeoSiteSSKV loads a GeoSite data file and builds a Set for every category.
+// The keys of the map (site keys) are all normalized to lowercase.
+// Prefer GeoSiteIndex when only a few categories are needed.
 func LoadGeoSiteSSKV(filename string) (map[string]*Set, error) {
-	bs, err := os.ReadFile(filename)
+	x, err := OpenGeoSiteIndex(filename)
 	if err != nil {
 		return nil, err
 	}
-	var list GeoSiteList
-	if err := proto.Unmarshal(bs, &list); err != nil {
-		return nil, err
-	}
+	defer x.Close()
 	m := make(map[string]*Set)
-	for _, entry := range list.Entry {
-		strs := make([]string, 0, len(entry.Domain))
-		for _, domain := range entry.Domain {
-			switch domain.Type {
-			case Domain_Plain:
-				fallthrough
-			case Domain_Full:
-				fallthrough
-			case Domain_RootDomain:
-				{
-					strs = append(strs, domain.Value)
-				}
-			case Domain_Regex:
-			default:
-
-			}
+	for _, name := range x.Names() {
+		set, err := x.LoadSet(name)
+		if err != nil {
+			return nil, err
 		}
-		if len(strs) > 0 {
-			m[strings.ToLower(entry.CountryCode)] = NewSet(strs)
+		if set != nil {
+			m[name] = set
 		} else {
-			log.Println(entry.CountryCode)
+			log.Println(name)
 		}
 	}
 	return m, nil
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package v2geo
+
+import "os"
+
+// mapFile falls back to reading the whole file on platforms without mmap.
+func mapFile(filename string) ([]byte, bool, error) {
+	data, err := os.ReadFile(filename)
+	return data, false, err
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build unix
+
+package v2geo
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps a file read-only into memory.
+// Empty files can't be mapped, they are returned as an empty slice.
+func mapFile(filename string) ([]byte, bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if info.Size() == 0 {
+		return []byte{}, false, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(info.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
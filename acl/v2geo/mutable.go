@@ -0,0 +1,284 @@
+package v2geo
+
+import (
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const defaultCompactThreshold = 4096
+
+type entryKey struct {
+	domain string
+	exact  bool
+}
+
+func parseEntry(entry string) entryKey {
+	if strings.HasPrefix(entry, PrefixFull) {
+		return entryKey{entry[len(PrefixFull):], true}
+	}
+	return entryKey{strings.TrimPrefix(entry, PrefixDomain), false}
+}
+
+// NormalizeEntry returns an entry in the form Keys yields it:
+// PrefixDomain is dropped, PrefixFull is kept.
+func NormalizeEntry(entry string) string {
+	return parseEntry(entry).String()
+}
+
+func (k entryKey) String() string {
+	if k.exact {
+		return PrefixFull + k.domain
+	}
+	return k.domain
+}
+
+// MutableSet is a domain set that supports inserts and deletes.
+// It is made of an immutable Set as its base, plus small overlays that record
+// the changes since the base was built. Changes are visible immediately, and
+// are compacted into a new base in the background once enough of them pile up.
+// It is safe for concurrent use.
+type MutableSet struct {
+	// CompactThreshold is the number of pending changes that triggers a
+	// background compaction. Defaults to 4096, negative disables it.
+	CompactThreshold int
+
+	mu      sync.RWMutex
+	base    *Set
+	overlay map[entryKey]bool // true: inserted, false: deleted
+	frozen  map[entryKey]bool // overlay being compacted into the next base
+	deletes int               // deletes in overlay and frozen
+
+	compactMu  sync.Mutex
+	compacting atomic.Bool
+}
+
+// NewMutableSet creates a MutableSet on top of base, which may be nil.
+func NewMutableSet(base *Set) *MutableSet {
+	return &MutableSet{
+		base:    base,
+		overlay: make(map[entryKey]bool),
+	}
+}
+
+// Insert adds an entry, see NewSet for the syntax.
+// Returns false if the entry was already stored.
+func (m *MutableSet) Insert(entry string) bool {
+	return m.update(parseEntry(entry), true)
+}
+
+// Delete removes an entry. Only the entry itself is removed, other entries
+// that match the same domain are kept.
+// Returns false if the entry was not stored.
+func (m *MutableSet) Delete(entry string) bool {
+	return m.update(parseEntry(entry), false)
+}
+
+func (m *MutableSet) update(k entryKey, present bool) bool {
+	m.mu.Lock()
+	if m.stored(k) == present {
+		m.mu.Unlock()
+		return false
+	}
+	if old, ok := m.overlay[k]; ok && !old {
+		m.deletes--
+	}
+	m.overlay[k] = present
+	if !present {
+		m.deletes++
+	}
+	pending := len(m.overlay)
+	m.mu.Unlock()
+
+	threshold := m.CompactThreshold
+	if threshold == 0 {
+		threshold = defaultCompactThreshold
+	}
+	if threshold > 0 && pending >= threshold && m.compacting.CompareAndSwap(false, true) {
+		go func() {
+			defer m.compacting.Store(false)
+			_ = m.Compact()
+		}()
+	}
+	return true
+}
+
+// stored reports whether the entry itself is in the set. Must hold m.mu.
+func (m *MutableSet) stored(k entryKey) bool {
+	if v, ok := m.overlay[k]; ok {
+		return v
+	}
+	if v, ok := m.frozen[k]; ok {
+		return v
+	}
+	return m.base != nil && m.base.hasEntry(k.domain, k.exact)
+}
+
+// Contains reports whether the entry itself is stored, as opposed to Has,
+// which also takes other matching entries into account.
+func (m *MutableSet) Contains(entry string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.stored(parseEntry(entry))
+}
+
+// Has query for a key and return whether it presents in the MutableSet.
+func (m *MutableSet) Has(key string) bool {
+	_, ok := m.Match(key)
+	return ok
+}
+
+// Match works like Set.Match.
+func (m *MutableSet) Match(key string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored := m.stored
+	if m.deletes == 0 {
+		// Nothing in the base is shadowed, so it can be asked on its own,
+		// and only the overlays have to be checked entry by entry.
+		if m.base != nil {
+			if hit, ok := m.base.Match(key); ok {
+				return hit, true
+			}
+		}
+		if len(m.overlay) == 0 && len(m.frozen) == 0 {
+			return "", false
+		}
+		stored = func(k entryKey) bool {
+			return m.overlay[k] || m.frozen[k]
+		}
+	}
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] == '.' && stored(entryKey{key[i+1:], false}) {
+			return key[i+1:], true
+		}
+	}
+	if stored(entryKey{key, false}) || stored(entryKey{key, true}) {
+		return key, true
+	}
+	return "", false
+}
+
+// Keys returns an iterator over a snapshot of all entries, in no particular order.
+func (m *MutableSet) Keys() iter.Seq[string] {
+	m.mu.RLock()
+	base := m.base
+	changes := maps.Clone(m.frozen)
+	if changes == nil {
+		changes = make(map[entryKey]bool, len(m.overlay))
+	}
+	maps.Copy(changes, m.overlay)
+	m.mu.RUnlock()
+
+	return func(yield func(string) bool) {
+		if base != nil {
+			for key := range base.Keys() {
+				if _, ok := changes[parseEntry(key)]; ok {
+					continue
+				}
+				if !yield(key) {
+					return
+				}
+			}
+		}
+		for k, present := range changes {
+			if present && !yield(k.String()) {
+				return
+			}
+		}
+	}
+}
+
+// Base returns the immutable Set of the last compaction.
+func (m *MutableSet) Base() *Set {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.base
+}
+
+// Pending returns the number of changes not compacted into the base yet.
+func (m *MutableSet) Pending() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.overlay) + len(m.frozen)
+}
+
+// Compact merges all pending changes into a new base Set.
+// Lookups and updates keep working while the new base is built.
+func (m *MutableSet) Compact() error {
+	m.compactMu.Lock()
+	defer m.compactMu.Unlock()
+
+	m.mu.Lock()
+	if len(m.overlay) == 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	m.frozen, m.overlay = m.overlay, make(map[entryKey]bool)
+	frozen, base := m.frozen, m.base
+	m.mu.Unlock()
+
+	var inserts []string
+	for k, present := range frozen {
+		if present {
+			inserts = append(inserts, reverseDomainKey(k.String()))
+		}
+	}
+	slices.Sort(inserts)
+	seqs := []iter.Seq[string]{slices.Values(inserts)}
+	if base != nil {
+		seqs = append(seqs, filterKeys(base.rawKeys(), func(key string) bool {
+			domain, exact := domainOfKey(key)
+			_, changed := frozen[entryKey{domain, exact}]
+			return !changed
+		}))
+	}
+	ss, err := buildSet(mergeSorted(seqs...))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		// Put the changes back, without overriding newer ones.
+		for k, v := range frozen {
+			if _, ok := m.overlay[k]; !ok {
+				m.overlay[k] = v
+			}
+		}
+		m.frozen = nil
+		m.recountDeletes()
+		return err
+	}
+	m.base = ss
+	m.frozen = nil
+	m.recountDeletes()
+	return nil
+}
+
+func (m *MutableSet) recountDeletes() {
+	m.deletes = 0
+	for _, present := range m.overlay {
+		if !present {
+			m.deletes++
+		}
+	}
+}
+
+// Size returns the approximate memory used by the MutableSet in bytes.
+func (m *MutableSet) Size() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	size := 0
+	if m.base != nil {
+		size = m.base.Size()
+	}
+	for k := range m.overlay {
+		size += len(k.domain) + 32
+	}
+	for k := range m.frozen {
+		size += len(k.domain) + 32
+	}
+	return size
+}
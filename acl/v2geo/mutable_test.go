@@ -0,0 +1,80 @@
+package v2geo
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMutableSet(t *testing.T) {
+	m := NewMutableSet(NewSet([]string{"google.com", "full:example.com"}))
+	m.CompactThreshold = -1
+
+	assert.True(t, m.Has("www.google.com"))
+	assert.False(t, m.Has("apple.com"))
+
+	assert.True(t, m.Insert("apple.com"))
+	assert.False(t, m.Insert("apple.com"))
+	assert.False(t, m.Insert("google.com"))
+	assert.True(t, m.Has("www.apple.com"))
+	hit, ok := m.Match("www.apple.com")
+	assert.True(t, ok)
+	assert.Equal(t, "apple.com", hit)
+
+	assert.True(t, m.Insert("full:example.org"))
+	assert.True(t, m.Has("example.org"))
+	assert.False(t, m.Has("www.example.org"))
+
+	assert.True(t, m.Delete("google.com"))
+	assert.False(t, m.Delete("google.com"))
+	assert.False(t, m.Has("www.google.com"))
+	assert.False(t, m.Has("google.com"))
+	assert.True(t, m.Has("example.com"))
+	assert.False(t, m.Contains("google.com"))
+	assert.True(t, m.Contains("full:example.com"))
+
+	want := []string{"full:example.com", "apple.com", "full:example.org"}
+	assert.ElementsMatch(t, want, slices.Collect(m.Keys()))
+	assert.Equal(t, 3, m.Pending())
+
+	assert.NoError(t, m.Compact())
+	assert.Equal(t, 0, m.Pending())
+	assert.ElementsMatch(t, want, slices.Collect(m.Base().Keys()))
+	assert.False(t, m.Has("www.google.com"))
+	assert.True(t, m.Has("www.apple.com"))
+
+	assert.True(t, m.Insert("google.com"))
+	assert.True(t, m.Has("mail.google.com"))
+}
+
+func TestMutableSetEmptyBase(t *testing.T) {
+	m := NewMutableSet(nil)
+	assert.False(t, m.Has("example.com"))
+	assert.True(t, m.Insert("example.com"))
+	assert.True(t, m.Has("a.example.com"))
+	assert.NoError(t, m.Compact())
+	assert.True(t, m.Has("a.example.com"))
+}
+
+func TestMutableSetConcurrent(t *testing.T) {
+	m := NewMutableSet(nil)
+	m.CompactThreshold = 50
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				domain := fmt.Sprintf("d%d-%d.example.com", w, i)
+				m.Insert(domain)
+				assert.True(t, m.Has("www."+domain))
+			}
+		}(w)
+	}
+	wg.Wait()
+	assert.NoError(t, m.Compact())
+	assert.Len(t, slices.Collect(m.Base().Keys()), 2000)
+}
@@ -1,9 +1,11 @@
 package v2geo
 
 import (
+	"iter"
 	"reflect"
-	/*"slices"*/
-	"golang.org/x/exp/slices"
+	"runtime"
+	"slices"
+	"strings"
 	"unsafe"
 
 	"github.com/openacid/low/bitmap"
@@ -11,67 +13,62 @@ import (
 
 // mod from https://github.com/openacid/succinct
 
-const prefixLabel = '\r'
+// Every key ends with a terminal label that also records how it matches:
+// prefixLabel for suffix entries, exactLabel for exact-only entries.
+// Both sort before any character allowed in a domain name, so terminals are
+// always the first labels of a node.
+const (
+	prefixLabel = '\r'
+	exactLabel  = '\n'
+)
+
+// Entries passed to NewSet may carry one of these prefixes,
+// following the v2ray domain list syntax. Entries without one are suffix entries.
+const (
+	PrefixFull   = "full:"   // matches the domain only
+	PrefixDomain = "domain:" // matches the domain and all of its subdomains
+)
 
 type Set struct {
 	leaves, labelBitmap []uint64
 	labels              []byte
 	ranks, selects      []int32
+
+	mapped *setMapping // file mapping backing the fields above, see LoadSetFile
 }
 
-// NewSet creates a new *Set struct, from a slice of sorted strings.
+// NewSet creates a new *Set struct, from a slice of strings.
+// See PrefixFull and PrefixDomain for how each entry matches.
+// Use SetBuilder for lists too large to hold in memory twice.
 func NewSet(strs []string) *Set {
-
 	keys := make([]string, 0, len(strs))
-	seen := make(map[string]bool, len(strs))
 	for _, v := range strs {
-		if seen[v] {
-			continue
-		}
-		seen[v] = true
-		keys = append(keys, reverseDomainSuffix(v))
+		keys = append(keys, reverseDomainKey(v))
 	}
-
 	slices.Sort(keys)
-	ss := &Set{}
-	lIdx := 0
-
-	type qElt struct{ s, e, col int }
-
-	queue := []qElt{{0, len(keys), 0}}
-
-	for i := 0; i < len(queue); i++ {
-		elt := queue[i]
-
-		if elt.col == len(keys[elt.s]) {
-			// a leaf node
-			elt.s++
-			setBit(&ss.leaves, i, 1)
-		}
-
-		for j := elt.s; j < elt.e; {
-
-			frm := j
-
-			for ; j < elt.e && keys[j][elt.col] == keys[frm][elt.col]; j++ {
-			}
-
-			queue = append(queue, qElt{frm, j, elt.col + 1})
-			ss.labels = append(ss.labels, keys[frm][elt.col])
-			setBit(&ss.labelBitmap, lIdx, 0)
-			lIdx++
-		}
-
-		setBit(&ss.labelBitmap, lIdx, 1)
-		lIdx++
-	}
-
-	ss.init()
+	keys = slices.Compact(keys)
+	ss, _ := buildSet(slices.Values(keys))
 	return ss
 }
 
 // Has query for a key and return whether it presents in the Set.
 func (ss *Set) Has(key string) bool {
+	_, ok := ss.Match(key)
+	return ok
+}
+
+// Match queries for a key like Has, and also returns the stored entry that
+// matched it, e.g. "google.com" for "www.google.com". When several entries
+// match, the shortest one is returned.
+// Exact entries only match the key itself.
+func (ss *Set) Match(key string) (string, bool) {
+	return ss.lookup(key, true)
+}
+
+// lookup is Match, but exact entries are only considered when exactOK is set.
+func (ss *Set) lookup(key string, exactOK bool) (string, bool) {
+	// The fields may point into a mapping that is released with ss.
+	defer runtime.KeepAlive(ss)
 	kbs := s2b(key)
 	klen := len(kbs)
 	nodeId, bmIdx := 0, 0
@@ -79,40 +76,114 @@ func (ss *Set) Has(key string) bool {
 	for i := klen - 1; i >= 0; i-- {
 		c := kbs[i]
 		for ; ; bmIdx++ {
-			//log.Printf("%c", c)
 			if getBit(ss.labelBitmap, bmIdx) != 0 {
 				// no more labels in this node
-				//if c == '.' {
-				//	return true
-				//} else {
-				//	return false
-				//}
-				return false
+				return "", false
 			}
 
 			la := ss.labels[bmIdx-nodeId]
-			// isPrefix := la == '\r'
-			// if isPrefix {
-			// 	log.Printf("%c '/r' \n", c)
-			// } else {
-			// 	log.Printf("%c '%c'\n", c, la)
-			// }
-
 			if c == '.' && la == prefixLabel {
-				return true
+				return key[i+1:], true
 			}
 			if la == c {
 				break
 			}
 		}
-		// log.Printf("%c\n", c)
 		// go to next level
 
 		nodeId = countZeros(ss.labelBitmap, ss.ranks, bmIdx+1)
 		bmIdx = selectIthOne(ss.labelBitmap, ss.ranks, ss.selects, nodeId-1) + 1
 	}
 
-	return ss.labels[bmIdx-nodeId] == prefixLabel
+	for ; getBit(ss.labelBitmap, bmIdx) == 0; bmIdx++ {
+		la := ss.labels[bmIdx-nodeId]
+		if la == prefixLabel || (la == exactLabel && exactOK) {
+			return key, true
+		}
+		if la > prefixLabel {
+			break
+		}
+	}
+	return "", false
+}
+
+// hasEntry reports whether the Set stores the domain itself as an entry
+// of the given mode, regardless of what else would match it.
+func (ss *Set) hasEntry(domain string, exact bool) bool {
+	if len(ss.labelBitmap) == 0 {
+		return false
+	}
+	defer runtime.KeepAlive(ss)
+	terminal := byte(prefixLabel)
+	if exact {
+		terminal = exactLabel
+	}
+	nodeId, bmIdx := 0, 0
+	for i := len(domain); i >= 0; i-- {
+		c := terminal
+		if i > 0 {
+			c = domain[i-1]
+		}
+		for ; ; bmIdx++ {
+			if getBit(ss.labelBitmap, bmIdx) != 0 {
+				return false
+			}
+			if ss.labels[bmIdx-nodeId] == c {
+				break
+			}
+		}
+		if i == 0 {
+			return true
+		}
+		nodeId = countZeros(ss.labelBitmap, ss.ranks, bmIdx+1)
+		bmIdx = selectIthOne(ss.labelBitmap, ss.ranks, ss.selects, nodeId-1) + 1
+	}
+	return false
+}
+
+// Keys returns an iterator over all entries stored in the Set.
+// Entries are yielded in the order of their reversed form,
+// so entries under the same suffix are grouped together.
+// Exact entries are yielded with PrefixFull, so the keys can be fed back to NewSet.
+func (ss *Set) Keys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for key := range ss.rawKeys() {
+			if !yield(keyToEntry(key)) {
+				return
+			}
+		}
+	}
+}
+
+// rawKeys iterates over the keys as stored in the trie, in sorted order.
+func (ss *Set) rawKeys() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		if len(ss.labelBitmap) == 0 {
+			return
+		}
+		ss.walk(0, 0, make([]byte, 0, 64), yield)
+		runtime.KeepAlive(ss)
+	}
+}
+
+// walk visits the subtree of a node in label order,
+// path holds the labels from the root to the node.
+func (ss *Set) walk(nodeId, bmIdx int, path []byte, yield func(string) bool) bool {
+	for ; getBit(ss.labelBitmap, bmIdx) == 0; bmIdx++ {
+		la := ss.labels[bmIdx-nodeId]
+		if la == prefixLabel || la == exactLabel {
+			if !yield(string(append(path, la))) {
+				return false
+			}
+			continue
+		}
+		childId := countZeros(ss.labelBitmap, ss.ranks, bmIdx+1)
+		childIdx := selectIthOne(ss.labelBitmap, ss.ranks, ss.selects, childId-1) + 1
+		if !ss.walk(childId, childIdx, append(path, la), yield) {
+			return false
+		}
+	}
+	return true
 }
 
 func setBit(bm *[]uint64, i int, v int) {
@@ -153,17 +224,49 @@ func selectIthOne(bm []uint64, ranks, selects []int32, i int) int {
 	return int(a)
 }
 
-func reverseDomainSuffix(domain string) string {
+// reverseDomainKey turns an entry into the key stored in the trie:
+// the reversed domain followed by its terminal label.
+func reverseDomainKey(entry string) string {
+	label := byte(prefixLabel)
+	domain := entry
+	if strings.HasPrefix(entry, PrefixFull) {
+		domain = entry[len(PrefixFull):]
+		label = exactLabel
+	} else if strings.HasPrefix(entry, PrefixDomain) {
+		domain = entry[len(PrefixDomain):]
+	}
 	l := len(domain)
-	b := []byte(domain)
-	for i := 0; i < l/2; i++ {
+	b := make([]byte, l+1)
+	for i := 0; i < l; i++ {
 		b[i] = domain[l-i-1]
-		b[l-i-1] = domain[i]
 	}
-	b = append(b, prefixLabel)
+	b[l] = label
 	return string(b)
 }
 
+// keyToEntry turns a key stored in the trie back into an entry for NewSet.
+func keyToEntry(key string) string {
+	l := len(key) - 1
+	b := make([]byte, l)
+	for i := 0; i < l; i++ {
+		b[l-1-i] = key[i]
+	}
+	if key[l] == exactLabel {
+		return PrefixFull + string(b)
+	}
+	return string(b)
+}
+
+// domainOfKey returns the domain of a key stored in the trie, and whether
+// it is an exact entry.
+func domainOfKey(key string) (string, bool) {
+	entry := keyToEntry(key)
+	if strings.HasPrefix(entry, PrefixFull) {
+		return entry[len(PrefixFull):], true
+	}
+	return entry, false
+}
+
 func s2b(s string) (b []byte) {
 	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
 	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
@@ -0,0 +1,320 @@
+package v2geo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sync"
+	"unsafe"
+
+	"github.com/openacid/low/bitmap"
+)
+
+// Binary layout of a serialized Set, all integers little endian:
+//
+//	magic    [4]byte "SSKV"
+//	version  uint16
+//	reserved uint16
+//	counts   [5]uint32  len(leaves), len(labelBitmap), len(ranks), len(selects), len(labels)
+//	padding  to 8 bytes
+//	stamp    uint64     what the Set was built from, see WriteSetFile
+//	leaves, labelBitmap []uint64
+//	ranks, selects      []int32, each padded to 8 bytes
+//	labels              []byte, padded to 8 bytes
+//	checksum uint32     CRC-32C of everything before it
+//
+// Every section starts 8-byte aligned, so a page-aligned mapping of the file
+// can be used in place on little endian hosts.
+
+const (
+	setBinaryMagic   = "SSKV"
+	setBinaryVersion = 3 // 2: exact entries (full:) have their own terminal label, 3: stamp
+
+	setHeaderSize   = 40
+	setStampOffset  = 32
+	setChecksumSize = 4
+)
+
+var (
+	ErrSetBinaryMagic    = errors.New("v2geo: not a serialized Set")
+	ErrSetBinaryVersion  = errors.New("v2geo: unsupported Set format version")
+	ErrSetBinaryChecksum = errors.New("v2geo: Set checksum mismatch")
+	ErrSetBinaryCorrupt  = errors.New("v2geo: corrupt Set data")
+	ErrSetBinaryStale    = errors.New("v2geo: Set built from other data")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func align8(n int) int {
+	return (n + 7) &^ 7
+}
+
+type setLayout struct {
+	nLeaves, nBitmap, nRanks, nSelects, nLabels int
+	offLeaves, offBitmap, offRanks, offSelects  int
+	offLabels, offChecksum                      int
+}
+
+func newSetLayout(nLeaves, nBitmap, nRanks, nSelects, nLabels int) setLayout {
+	l := setLayout{
+		nLeaves:  nLeaves,
+		nBitmap:  nBitmap,
+		nRanks:   nRanks,
+		nSelects: nSelects,
+		nLabels:  nLabels,
+	}
+	l.offLeaves = setHeaderSize
+	l.offBitmap = l.offLeaves + nLeaves*8
+	l.offRanks = l.offBitmap + nBitmap*8
+	l.offSelects = l.offRanks + align8(nRanks*4)
+	l.offLabels = l.offSelects + align8(nSelects*4)
+	l.offChecksum = l.offLabels + align8(nLabels)
+	return l
+}
+
+func (l setLayout) size() int {
+	return l.offChecksum + setChecksumSize
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (ss *Set) MarshalBinary() ([]byte, error) {
+	return ss.marshal(0), nil
+}
+
+func (ss *Set) marshal(stamp uint64) []byte {
+	l := newSetLayout(len(ss.leaves), len(ss.labelBitmap), len(ss.ranks), len(ss.selects), len(ss.labels))
+	b := make([]byte, l.size())
+	copy(b, setBinaryMagic)
+	binary.LittleEndian.PutUint16(b[4:], setBinaryVersion)
+	binary.LittleEndian.PutUint64(b[setStampOffset:], stamp)
+	for i, n := range []int{l.nLeaves, l.nBitmap, l.nRanks, l.nSelects, l.nLabels} {
+		binary.LittleEndian.PutUint32(b[8+i*4:], uint32(n))
+	}
+	for i, v := range ss.leaves {
+		binary.LittleEndian.PutUint64(b[l.offLeaves+i*8:], v)
+	}
+	for i, v := range ss.labelBitmap {
+		binary.LittleEndian.PutUint64(b[l.offBitmap+i*8:], v)
+	}
+	for i, v := range ss.ranks {
+		binary.LittleEndian.PutUint32(b[l.offRanks+i*4:], uint32(v))
+	}
+	for i, v := range ss.selects {
+		binary.LittleEndian.PutUint32(b[l.offSelects+i*4:], uint32(v))
+	}
+	copy(b[l.offLabels:], ss.labels)
+	binary.LittleEndian.PutUint32(b[l.offChecksum:], crc32.Checksum(b[:l.offChecksum], crcTable))
+	return b
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+// The Set gets its own copy of the data.
+func (ss *Set) UnmarshalBinary(data []byte) error {
+	l, err := checkSetBinary(data)
+	if err != nil {
+		return err
+	}
+	*ss = Set{
+		leaves:      make([]uint64, l.nLeaves),
+		labelBitmap: make([]uint64, l.nBitmap),
+		ranks:       make([]int32, l.nRanks),
+		selects:     make([]int32, l.nSelects),
+		labels:      make([]byte, l.nLabels),
+	}
+	for i := range ss.leaves {
+		ss.leaves[i] = binary.LittleEndian.Uint64(data[l.offLeaves+i*8:])
+	}
+	for i := range ss.labelBitmap {
+		ss.labelBitmap[i] = binary.LittleEndian.Uint64(data[l.offBitmap+i*8:])
+	}
+	for i := range ss.ranks {
+		ss.ranks[i] = int32(binary.LittleEndian.Uint32(data[l.offRanks+i*4:]))
+	}
+	for i := range ss.selects {
+		ss.selects[i] = int32(binary.LittleEndian.Uint32(data[l.offSelects+i*4:]))
+	}
+	copy(ss.labels, data[l.offLabels:])
+	if err := ss.check(); err != nil {
+		*ss = Set{}
+		return err
+	}
+	return nil
+}
+
+// check validates the structure of a Set read from outside, so that lookups
+// can't go out of bounds or loop on corrupt data.
+func (ss *Set) check() error {
+	selects, ranks := bitmap.IndexSelect32R64(ss.labelBitmap)
+	if !slices.Equal(selects, ss.selects) || !slices.Equal(ranks, ss.ranks) {
+		return ErrSetBinaryCorrupt
+	}
+	// Each node ends with a 1 and each label is a 0. The i-th label leads to
+	// node i+1, which must come after the node holding the label.
+	nBits := len(ss.labelBitmap) * 64
+	for nBits > 0 && getBit(ss.labelBitmap, nBits-1) == 0 {
+		nBits--
+	}
+	ones, zeros := 0, 0
+	for i := 0; i < nBits; i++ {
+		if getBit(ss.labelBitmap, i) != 0 {
+			ones++
+			continue
+		}
+		if ones > zeros {
+			return ErrSetBinaryCorrupt
+		}
+		zeros++
+	}
+	if ones == 0 || ones != zeros+1 || zeros != len(ss.labels) || len(ss.leaves) > (ones+63)/64 {
+		return ErrSetBinaryCorrupt
+	}
+	return nil
+}
+
+// checkSetBinary validates the header and checksum of a serialized Set.
+func checkSetBinary(data []byte) (setLayout, error) {
+	if len(data) < setHeaderSize+setChecksumSize || string(data[:4]) != setBinaryMagic {
+		return setLayout{}, ErrSetBinaryMagic
+	}
+	if v := binary.LittleEndian.Uint16(data[4:]); v != setBinaryVersion {
+		return setLayout{}, fmt.Errorf("%w: %d", ErrSetBinaryVersion, v)
+	}
+	var n [5]int
+	for i := range n {
+		n[i] = int(binary.LittleEndian.Uint32(data[8+i*4:]))
+	}
+	l := newSetLayout(n[0], n[1], n[2], n[3], n[4])
+	if l.size() != len(data) {
+		return setLayout{}, ErrSetBinaryCorrupt
+	}
+	if binary.LittleEndian.Uint32(data[l.offChecksum:]) != crc32.Checksum(data[:l.offChecksum], crcTable) {
+		return setLayout{}, ErrSetBinaryChecksum
+	}
+	return l, nil
+}
+
+// WriteSetFile serializes a Set into a file, atomically replacing it.
+// stamp identifies the data the Set was built from, e.g. a hash of the size
+// and modification time of the source file, so that LoadSetFile can tell
+// when the file is stale.
+func WriteSetFile(filename string, ss *Set, stamp uint64) error {
+	b := ss.marshal(stamp)
+	// Each writer has its own temporary file, the last rename wins.
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// LoadSetFile loads a serialized Set from a file, which must have been
+// written with the same stamp, or ErrSetBinaryStale is returned.
+// Where supported, the file is mapped read-only and the bitmaps are used in
+// place without copying. The mapping is released by Close, or once the Set
+// is garbage collected.
+func LoadSetFile(filename string, stamp uint64) (*Set, error) {
+	data, mapped, err := mapFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := newSetInPlace(data, stamp)
+	if err != nil {
+		if mapped {
+			_ = unmapFile(data)
+		}
+		return nil, err
+	}
+	if mapped {
+		m := &setMapping{data: data}
+		ss.mapped = m
+		runtime.AddCleanup(ss, func(m *setMapping) { _ = m.close() }, m)
+	}
+	return ss, nil
+}
+
+// setMapping is the file mapping backing a Set loaded by LoadSetFile.
+type setMapping struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+func (m *setMapping) close() error {
+	m.once.Do(func() {
+		m.err = unmapFile(m.data)
+	})
+	return m.err
+}
+
+// newSetInPlace builds a Set that references data directly when the host
+// byte order and the alignment of data allow it, and copies otherwise.
+func newSetInPlace(data []byte, stamp uint64) (*Set, error) {
+	l, err := checkSetBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(data[setStampOffset:]) != stamp {
+		return nil, ErrSetBinaryStale
+	}
+	if !nativeLittleEndian || uintptr(unsafe.Pointer(unsafe.SliceData(data)))%8 != 0 {
+		ss := &Set{}
+		if err := ss.UnmarshalBinary(data); err != nil {
+			return nil, err
+		}
+		return ss, nil
+	}
+	ss := &Set{
+		leaves:      sliceAt[uint64](data, l.offLeaves, l.nLeaves),
+		labelBitmap: sliceAt[uint64](data, l.offBitmap, l.nBitmap),
+		ranks:       sliceAt[int32](data, l.offRanks, l.nRanks),
+		selects:     sliceAt[int32](data, l.offSelects, l.nSelects),
+		labels:      data[l.offLabels : l.offLabels+l.nLabels : l.offLabels+l.nLabels],
+	}
+	if err := ss.check(); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func sliceAt[T uint64 | int32](data []byte, off, n int) []T {
+	if n == 0 {
+		return nil
+	}
+	return unsafe.Slice((*T)(unsafe.Pointer(&data[off])), n)
+}
+
+var nativeLittleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// Close releases the file mapping of a Set loaded by LoadSetFile right away,
+// rather than when the Set is garbage collected. The Set must not be used
+// afterwards. It's a no-op for other Sets.
+func (ss *Set) Close() error {
+	if ss.mapped == nil {
+		return nil
+	}
+	m := ss.mapped
+	*ss = Set{}
+	return m.close()
+}
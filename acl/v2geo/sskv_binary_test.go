@@ -0,0 +1,133 @@
+package v2geo
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testSetDomains = []string{"google.com", "gstatic.com", "apple.com", "a.b.example.org"}
+
+func assertTestSet(t *testing.T, ss *Set) {
+	assert.True(t, ss.Has("google.com"))
+	assert.True(t, ss.Has("www.gstatic.com"))
+	assert.True(t, ss.Has("x.a.b.example.org"))
+	assert.False(t, ss.Has("b.example.org"))
+	assert.False(t, ss.Has("oogle.com"))
+}
+
+func TestSetBinaryRoundTrip(t *testing.T) {
+	ss := NewSet(testSetDomains)
+	bs, err := ss.MarshalBinary()
+	assert.NoError(t, err)
+
+	var ss2 Set
+	assert.NoError(t, ss2.UnmarshalBinary(bs))
+	assertTestSet(t, &ss2)
+
+	bs2, err := ss2.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, bs, bs2)
+}
+
+func TestSetBinaryErrors(t *testing.T) {
+	bs, err := NewSet(testSetDomains).MarshalBinary()
+	assert.NoError(t, err)
+
+	var ss Set
+	assert.ErrorIs(t, ss.UnmarshalBinary([]byte("nope")), ErrSetBinaryMagic)
+
+	corrupt := append([]byte(nil), bs...)
+	corrupt[setHeaderSize] ^= 0xff
+	assert.ErrorIs(t, ss.UnmarshalBinary(corrupt), ErrSetBinaryChecksum)
+
+	newer := append([]byte(nil), bs...)
+	newer[4] = setBinaryVersion + 1
+	assert.ErrorIs(t, ss.UnmarshalBinary(newer), ErrSetBinaryVersion)
+
+	assert.ErrorIs(t, ss.UnmarshalBinary(bs[:len(bs)-8]), ErrSetBinaryCorrupt)
+}
+
+func TestSetBinaryStructure(t *testing.T) {
+	bs, err := NewSet(testSetDomains).MarshalBinary()
+	assert.NoError(t, err)
+	l, err := checkSetBinary(bs)
+	assert.NoError(t, err)
+
+	// A valid checksum over a broken trie must not make lookups panic.
+	for i := l.offLeaves; i < l.offChecksum; i++ {
+		for _, flip := range []byte{0x01, 0x80, 0xff} {
+			b := append([]byte(nil), bs...)
+			b[i] ^= flip
+			binary.LittleEndian.PutUint32(b[l.offChecksum:], crc32.Checksum(b[:l.offChecksum], crcTable))
+			var ss Set
+			if err := ss.UnmarshalBinary(b); err != nil {
+				assert.ErrorIs(t, err, ErrSetBinaryCorrupt)
+				continue
+			}
+			assert.NotPanics(t, func() {
+				ss.Has("www.google.com")
+				ss.Has("a.b.example.org")
+				for range ss.Keys() {
+				}
+			}, "byte %d ^ %#x", i, flip)
+		}
+	}
+
+	b := append([]byte(nil), bs...)
+	b[l.offBitmap] ^= 0x01
+	binary.LittleEndian.PutUint32(b[l.offChecksum:], crc32.Checksum(b[:l.offChecksum], crcTable))
+	var ss Set
+	assert.ErrorIs(t, ss.UnmarshalBinary(b), ErrSetBinaryCorrupt)
+}
+
+func TestLoadSetFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.sskv")
+	assert.NoError(t, WriteSetFile(filename, NewSet(testSetDomains), 42))
+
+	ss, err := LoadSetFile(filename, 42)
+	assert.NoError(t, err)
+	assertTestSet(t, ss)
+	assert.NoError(t, ss.Close())
+
+	_, err = LoadSetFile(filename, 43)
+	assert.ErrorIs(t, err, ErrSetBinaryStale)
+
+	assert.NoError(t, os.WriteFile(filename, []byte{}, 0o644))
+	_, err = LoadSetFile(filename, 42)
+	assert.ErrorIs(t, err, ErrSetBinaryMagic)
+}
+
+func TestWriteSetFileConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.sskv")
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, WriteSetFile(filename, NewSet(testSetDomains), uint64(i)))
+		}()
+	}
+	wg.Wait()
+
+	ss, err := LoadSetFile(filename, setFileStamp(t, filename))
+	assert.NoError(t, err)
+	assertTestSet(t, ss)
+	assert.NoError(t, ss.Close())
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+// setFileStamp reads the stamp a Set file was written with.
+func setFileStamp(t *testing.T, filename string) uint64 {
+	bs, err := os.ReadFile(filename)
+	assert.NoError(t, err)
+	return binary.LittleEndian.Uint64(bs[setStampOffset:])
+}
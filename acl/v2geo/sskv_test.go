@@ -0,0 +1,67 @@
+package v2geo
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetMatch(t *testing.T) {
+	ss := NewSet(testSetDomains)
+	tests := []struct {
+		host string
+		want string
+		ok   bool
+	}{
+		{"google.com", "google.com", true},
+		{"www.google.com", "google.com", true},
+		{"a.b.gstatic.com", "gstatic.com", true},
+		{"x.a.b.example.org", "a.b.example.org", true},
+		{"b.example.org", "", false},
+		{"oogle.com", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := ss.Match(tt.host)
+		assert.Equalf(t, tt.ok, ok, "Match(%v)", tt.host)
+		assert.Equalf(t, tt.want, got, "Match(%v)", tt.host)
+	}
+}
+
+func TestSetKeys(t *testing.T) {
+	ss := NewSet(append(testSetDomains, "google.com", "mail.google.com"))
+	keys := slices.Collect(ss.Keys())
+	assert.ElementsMatch(t, append(testSetDomains, "mail.google.com"), keys)
+
+	var first []string
+	for k := range ss.Keys() {
+		first = append(first, k)
+		break
+	}
+	assert.Len(t, first, 1)
+}
+
+func TestSetExact(t *testing.T) {
+	ss := NewSet([]string{"full:example.com", "domain:example.org", "full:a.example.org", "full:google.com", "google.com"})
+	tests := []struct {
+		host string
+		want string
+		ok   bool
+	}{
+		{"example.com", "example.com", true},
+		{"www.example.com", "", false},
+		{"example.org", "example.org", true},
+		{"a.example.org", "example.org", true},
+		{"b.a.example.org", "example.org", true},
+		{"google.com", "google.com", true},
+		{"www.google.com", "google.com", true},
+	}
+	for _, tt := range tests {
+		got, ok := ss.Match(tt.host)
+		assert.Equalf(t, tt.ok, ok, "Match(%v)", tt.host)
+		assert.Equalf(t, tt.want, got, "Match(%v)", tt.host)
+	}
+	assert.ElementsMatch(t, []string{"full:example.com", "example.org", "full:a.example.org", "full:google.com", "google.com"},
+		slices.Collect(ss.Keys()))
+}
@@ -2,10 +2,17 @@ package route_rule
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/belowLevel/route_rule/acl"
+	"github.com/belowLevel/route_rule/acl/fakeip"
 	"github.com/belowLevel/route_rule/acl/outbound"
+	"github.com/stretchr/testify/assert"
 	"log"
+	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -26,11 +33,12 @@ func TestACL(t *testing.T) {
 		"v4_only(all)",
 	}
 	gLoader := &acl.GeoLoaderT{
-		DownloadFunc: func(filename, url string) {
-			t.Logf("%s %s", filename, url)
-		},
-		DownloadErrFunc: func(err error) {
-			t.Errorf("%v", err)
+		OnDownload: func(ev acl.DownloadEvent) {
+			if ev.Err != nil {
+				t.Errorf("%v", ev.Err)
+			} else if !ev.Done && ev.Bytes == 0 {
+				t.Logf("%s %s", ev.Filename, ev.URL)
+			}
 		},
 		AutoDL: true,
 	}
@@ -110,3 +118,148 @@ func buildOutbounds(urls map[string]string) []OutboundEntry {
 	})
 	return obs
 }
+
+func TestACLRuleFileRelativeData(t *testing.T) {
+	dir := t.TempDir()
+	rulesFile := filepath.Join(dir, "rules.acl")
+	assert.NoError(t, os.WriteFile(rulesFile, []byte("reject(domf:blocked.txt)\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "blocked.txt"), []byte("blocked.example\n"), 0o644))
+
+	obs := buildOutbounds(map[string]string{"reject": "reject://"})
+	aclO, err := NewACLEngineFromFileWithOptions(rulesFile, obs, acl.CompileOptions{})
+	assert.NoError(t, err)
+	_, err = aclO.TCP(context.Background(), &acl.AddrEx{Host: "www.blocked.example", Port: 443})
+	assert.EqualError(t, err, "rejected")
+}
+
+// hostOutbound records the hosts it is asked to connect to.
+type hostOutbound struct {
+	hosts []string
+}
+
+func (o *hostOutbound) TCP(ctx context.Context, reqAddr *acl.AddrEx) (net.Conn, error) {
+	o.hosts = append(o.hosts, reqAddr.Host)
+	return nil, errors.New("not connecting")
+}
+
+func (o *hostOutbound) UDP(reqAddr *acl.AddrEx) (acl.UDPConn, error) {
+	return nil, errors.New("not connecting")
+}
+
+func (o *hostOutbound) GetName() string {
+	return "host"
+}
+
+func TestACLFakeIP(t *testing.T) {
+	pool, err := fakeip.NewPool(fakeip.Options{})
+	assert.NoError(t, err)
+	ob := &hostOutbound{}
+	obs := append(buildOutbounds(map[string]string{"reject": "reject://"}),
+		OutboundEntry{Name: "host", Outbound: ob})
+	aclO, err := NewACLEngineFromStringWithOptions(`
+reject(suffix:blocked.example)
+host(all)
+`, obs, acl.CompileOptions{FakeIP: pool})
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	blocked := pool.Lookup("www.blocked.example")
+	_, err = aclO.TCP(ctx, &acl.AddrEx{Host: blocked.String(), Port: 443})
+	assert.EqualError(t, err, "rejected")
+
+	allowed := pool.Lookup("www.example.com")
+	reqAddr := &acl.AddrEx{Host: allowed.String(), Port: 443, HostInfo: &acl.HostInfo{IPv4: allowed.AsSlice()}}
+	_, _ = aclO.TCP(ctx, reqAddr)
+	assert.Equal(t, []string{"www.example.com"}, ob.hosts)
+	assert.Nil(t, reqAddr.HostInfo.IPv4)
+
+	_, err = aclO.TCP(ctx, &acl.AddrEx{Host: "198.18.100.1", Port: 443})
+	assert.EqualError(t, err, "fake IP 198.18.100.1 has no domain")
+	assert.Len(t, ob.hosts, 1)
+}
+
+// echoUDPOutbound answers each packet from the address it was sent to,
+// which it resolves to 192.0.2.1.
+type echoUDPOutbound struct{}
+
+func (echoUDPOutbound) TCP(ctx context.Context, reqAddr *acl.AddrEx) (net.Conn, error) {
+	return nil, errors.New("not connecting")
+}
+
+func (echoUDPOutbound) UDP(reqAddr *acl.AddrEx) (acl.UDPConn, error) {
+	return &echoUDPConn{}, nil
+}
+
+func (echoUDPOutbound) GetName() string {
+	return "echo"
+}
+
+type echoUDPConn struct {
+	last *acl.AddrEx
+}
+
+func (c *echoUDPConn) ReadFrom(b []byte) (int, *acl.AddrEx, error) {
+	return 0, &acl.AddrEx{Host: c.last.HostInfo.IPv4.String(), Port: c.last.Port}, nil
+}
+
+func (c *echoUDPConn) WriteTo(b []byte, addr *acl.AddrEx) (int, error) {
+	addr.HostInfo.SetIPs([]acl.ResolvedIP{{IP: net.ParseIP("192.0.2.1")}})
+	c.last = addr
+	return len(b), nil
+}
+
+func (c *echoUDPConn) Close() error {
+	return nil
+}
+
+func TestACLFakeIPUDP(t *testing.T) {
+	pool, err := fakeip.NewPool(fakeip.Options{})
+	assert.NoError(t, err)
+	aclO, err := NewACLEngineFromStringWithOptions("echo(all)\n",
+		[]OutboundEntry{{Name: "echo", Outbound: echoUDPOutbound{}}}, acl.CompileOptions{FakeIP: pool})
+	assert.NoError(t, err)
+
+	fake := pool.Lookup("dns.example").String()
+	conn, err := aclO.UDP(&acl.AddrEx{Host: fake, Port: 53})
+	assert.NoError(t, err)
+	_, err = conn.WriteTo([]byte("query"), &acl.AddrEx{Host: fake, Port: 53})
+	assert.NoError(t, err)
+	// The reply comes from the fake IP the client sent to.
+	_, from, err := conn.ReadFrom(make([]byte, 16))
+	assert.NoError(t, err)
+	assert.Equal(t, net.JoinHostPort(fake, "53"), from.String())
+
+	// The mappings are capped.
+	for i := 0; i < fakeIPUDPConnMappings; i++ {
+		host := pool.Lookup(fmt.Sprintf("%d.example", i)).String()
+		_, err = conn.WriteTo([]byte("query"), &acl.AddrEx{Host: host, Port: 53})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, fakeIPUDPConnMappings, conn.(*fakeIPUDPConn).fakes.Len())
+}
+
+// fakeIPResolver resolves every host to a fake IP, like a system resolver
+// pointing at the fake-IP DNS server.
+type fakeIPResolver struct {
+	ip net.IP
+}
+
+func (r fakeIPResolver) Resolve(ctx context.Context, host string) ([]acl.ResolvedIP, error) {
+	return []acl.ResolvedIP{{IP: r.ip}}, nil
+}
+
+func TestACLFakeIPOutboundResolver(t *testing.T) {
+	pool, err := fakeip.NewPool(fakeip.Options{})
+	assert.NoError(t, err)
+	direct, err := outbound.NewDirectOutboundWithOptions(outbound.DirectOutboundOptions{
+		Resolver: fakeIPResolver{pool.Lookup("loop.example").AsSlice()},
+	})
+	assert.NoError(t, err)
+	aclO, err := NewACLEngineFromStringWithOptions("direct(all)\n",
+		[]OutboundEntry{{Name: "direct", Outbound: direct}}, acl.CompileOptions{FakeIP: pool})
+	assert.NoError(t, err)
+
+	// The outbound resolves the host itself, to a fake IP.
+	_, err = aclO.TCP(context.Background(), &acl.AddrEx{Host: "www.example.com", Port: 443})
+	assert.ErrorContains(t, err, "refusing to connect to fake IP")
+}
@@ -0,0 +1,107 @@
+package route_rule
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+
+	"github.com/belowLevel/route_rule/acl"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// fakeIPUDPConnMappings is how many reply addresses a fakeIPUDPConn maps back
+// to fake IPs, the least recently used ones are dropped beyond that.
+const fakeIPUDPConnMappings = 1024
+
+type fakeIPError struct {
+	Addr     netip.Addr
+	Resolved bool
+}
+
+func (e fakeIPError) Error() string {
+	if e.Resolved {
+		return "host resolved to fake IP " + e.Addr.String()
+	}
+	return "fake IP " + e.Addr.String() + " has no domain"
+}
+
+// unmapFakeIP replaces a fake IP in reqAddr.Host with its domain, so that
+// rules match it and outbounds connect to the real host.
+func unmapFakeIP(m acl.FakeIPMapper, reqAddr *acl.AddrEx) error {
+	addr, err := netip.ParseAddr(reqAddr.Host)
+	if err != nil || !m.Contains(addr) {
+		return nil
+	}
+	host, ok := m.LookupHost(addr)
+	if !ok {
+		// Expired, or from before a restart without persistence.
+		return fakeIPError{Addr: addr}
+	}
+	reqAddr.Host = host
+	// Whatever was resolved belongs to the fake IP.
+	reqAddr.HostInfo = &acl.HostInfo{}
+	return nil
+}
+
+// checkResolved makes sure matching didn't resolve the host to a fake IP,
+// e.g. through a system resolver pointing at the fake-IP DNS server itself.
+func checkResolved(m acl.FakeIPMapper, reqAddr *acl.AddrEx) error {
+	for _, ip := range reqAddr.HostInfo.Addrs() {
+		if addr, ok := netip.AddrFromSlice(ip); ok && m.Contains(addr) {
+			return fakeIPError{Addr: addr.Unmap(), Resolved: true}
+		}
+	}
+	return nil
+}
+
+// fakeIPUDPConn unmaps the fake IPs packets are sent to, and maps the
+// sources of the replies back, so that they come from the address the client
+// sent to.
+type fakeIPUDPConn struct {
+	acl.UDPConn
+	fakeIP acl.FakeIPMapper
+	fakes  *lru.Cache[string, string] // real host:port -> fake IP
+}
+
+func newFakeIPUDPConn(conn acl.UDPConn, fakeIP acl.FakeIPMapper) *fakeIPUDPConn {
+	// Only fails for a size <= 0.
+	fakes, _ := lru.New[string, string](fakeIPUDPConnMappings)
+	return &fakeIPUDPConn{UDPConn: conn, fakeIP: fakeIP, fakes: fakes}
+}
+
+func (c *fakeIPUDPConn) ReadFrom(b []byte) (int, *acl.AddrEx, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	if addr != nil {
+		if fake, ok := c.fakes.Get(addr.String()); ok {
+			addr.Host = fake
+			addr.HostInfo = nil
+		}
+	}
+	return n, addr, err
+}
+
+func (c *fakeIPUDPConn) WriteTo(b []byte, addr *acl.AddrEx) (int, error) {
+	if addr.HostInfo == nil {
+		addr.HostInfo = &acl.HostInfo{}
+	}
+	fake := addr.Host
+	if err := unmapFakeIP(c.fakeIP, addr); err != nil {
+		return 0, err
+	}
+	n, err := c.UDPConn.WriteTo(b, addr)
+	if err == nil && addr.Host != fake {
+		c.remember(fake, addr)
+	}
+	return n, err
+}
+
+// remember maps the domain of addr, and the addresses the outbound sent to,
+// back to the fake IP.
+func (c *fakeIPUDPConn) remember(fake string, addr *acl.AddrEx) {
+	c.fakes.Add(addr.String(), fake)
+	port := strconv.Itoa(int(addr.Port))
+	for _, ip := range addr.HostInfo.Addrs() {
+		c.fakes.Add(net.JoinHostPort(ip.String(), port), fake)
+	}
+}